@@ -0,0 +1,144 @@
+package nix_http_cachefs
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	"go.uber.org/multierr"
+)
+
+// pruneInterval bounds how often the persistent cache is walked to expire entries
+// when it is not over its size limit.
+const pruneInterval = 10 * time.Minute
+
+// staleTempAge is how old a temporary file or orphaned sidecar must be before a prune
+// removes it. Younger ones may belong to a download still in progress in another process.
+const staleTempAge = time.Hour
+
+// cacheEntry is a cached body and its sidecar, which are evicted together.
+type cacheEntry struct {
+	body    string
+	size    int64
+	lastUse time.Time
+}
+
+// touch records that a cached body was used. The modification time is used rather
+// than the access time since many file systems are mounted noatime. It is shared
+// with every other process using the same cache directory.
+func (c *CachingRoundTripper) touch(cachePath *pathlib.Path) {
+	if c.MaxBytes <= 0 && c.MaxAge <= 0 {
+		return
+	}
+	now := time.Now()
+	_ = cachePath.Fs().Chtimes(cachePath.String(), now, now)
+}
+
+// stored accounts for a newly stored body, pruning the cache if it may now be over
+// its size limit or has not been pruned for a while.
+func (c *CachingRoundTripper) stored(size int64) {
+	if c.MaxBytes <= 0 && c.MaxAge <= 0 {
+		return
+	}
+	c.pruneMu.Lock()
+	c.size += size
+	due := (c.MaxBytes > 0 && c.size > c.MaxBytes) || time.Since(c.lastPrune) >= pruneInterval
+	c.pruneMu.Unlock()
+
+	if due {
+		_ = c.Prune()
+	}
+}
+
+// Prune evicts least recently used responses until the cache is within MaxBytes,
+// and any unused for longer than MaxAge. It is safe to run while other processes
+// use the same cache directory: bodies are removed before their sidecars, and a
+// response whose body has gone is simply fetched again.
+func (c *CachingRoundTripper) Prune() error {
+	c.pruneMu.Lock()
+	defer c.pruneMu.Unlock()
+
+	cacheFs := c.PersistentCache.Fs()
+	now := time.Now()
+
+	var errs error
+	entries := map[string]*cacheEntry{}
+	sidecars := map[string]os.FileInfo{}
+	err := afero.Walk(cacheFs, c.PersistentCache.String(), func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files can vanish under a concurrent prune.
+			if !os.IsNotExist(err) {
+				errs = multierr.Append(errs, err)
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(info.Name(), ".") && strings.Contains(info.Name(), ".tmp-"):
+			if now.Sub(info.ModTime()) > staleTempAge {
+				errs = multierr.Append(errs, removeIfExists(cacheFs, name))
+			}
+		case strings.HasSuffix(name, headersSuffix):
+			sidecars[strings.TrimSuffix(name, headersSuffix)] = info
+		default:
+			entries[name] = &cacheEntry{body: name, size: info.Size(), lastUse: info.ModTime()}
+		}
+		return nil
+	})
+	errs = multierr.Append(errs, err)
+
+	for body, info := range sidecars {
+		if entry, found := entries[body]; found {
+			entry.size += info.Size()
+			continue
+		}
+		// The body may be about to be renamed into place by another process.
+		if now.Sub(info.ModTime()) > staleTempAge {
+			errs = multierr.Append(errs, removeIfExists(cacheFs, body+headersSuffix))
+		}
+	}
+
+	lru := make([]*cacheEntry, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		lru = append(lru, entry)
+		total += entry.size
+	}
+	sort.Slice(lru, func(i, j int) bool {
+		return lru[i].lastUse.Before(lru[j].lastUse)
+	})
+
+	for _, entry := range lru {
+		expired := c.MaxAge > 0 && now.Sub(entry.lastUse) > c.MaxAge
+		overSize := c.MaxBytes > 0 && total > c.MaxBytes
+		if !expired && !overSize {
+			// Entries are ordered by last use, so every remaining one is newer.
+			break
+		}
+		err := multierr.Combine(
+			removeIfExists(cacheFs, entry.body),
+			removeIfExists(cacheFs, entry.body+headersSuffix),
+		)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		total -= entry.size
+	}
+
+	c.size = total
+	c.lastPrune = now
+	return errs
+}
+
+func removeIfExists(cacheFs afero.Fs, name string) error {
+	if err := cacheFs.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
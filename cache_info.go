@@ -0,0 +1,204 @@
+package nix_http_cachefs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPriority is the priority of caches which don't advertise one, as in nix.
+const defaultPriority = 50
+
+// cacheInfo is the nix-cache-info of a binary cache.
+// TODO: move into nix-sigman as a type
+type cacheInfo struct {
+	StoreDir      string
+	WantMassQuery bool
+	// Priority orders caches: lower values are queried first.
+	Priority int
+}
+
+// parseCacheInfo parses a nix-cache-info file. Unknown fields are ignored.
+func parseCacheInfo(r io.Reader) (*cacheInfo, error) {
+	info := &cacheInfo{Priority: defaultPriority}
+	bio := bufio.NewScanner(r)
+	for bio.Scan() {
+		fieldName, fieldValue, found := strings.Cut(bio.Text(), ":")
+		if !found {
+			continue
+		}
+		fieldValue = strings.TrimSpace(fieldValue)
+		switch fieldName {
+		case "StoreDir":
+			info.StoreDir = path.Clean(fieldValue)
+		case "WantMassQuery":
+			info.WantMassQuery = fieldValue == "1"
+		case "Priority":
+			priority, err := strconv.Atoi(fieldValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Priority: %w", err)
+			}
+			info.Priority = priority
+		}
+	}
+	if err := bio.Err(); err != nil {
+		return nil, err
+	}
+	if info.StoreDir == "" {
+		return nil, errors.New("no StoreDir")
+	}
+	return info, nil
+}
+
+// fetchCacheInfo requests the nix-cache-info of a cache.
+func (fs *nixHttpCacheFs) fetchCacheInfo(ctx context.Context, cacheUrl *url.URL) (*cacheInfo, error) {
+	infoUrl := cacheUrl.JoinPath("nix-cache-info").String()
+	fs.debugLog("HTTP Request", http.MethodGet, infoUrl)
+
+	resp, err := fs.get(ctx, cacheUrl, infoUrl, nil)
+	if err != nil {
+		return nil, &CacheError{URL: infoUrl, Kind: ErrTransient, Err: err}
+	}
+	defer resp.Body.Close()
+	if kind := statusKind(resp.StatusCode); kind != nil {
+		return nil, &CacheError{URL: infoUrl, Kind: kind, Err: errors.New(resp.Status)}
+	}
+	info, err := parseCacheInfo(resp.Body)
+	if err != nil {
+		return nil, &CacheError{URL: infoUrl, Kind: readKind(err), Err: err}
+	}
+	return info, nil
+}
+
+// cacheInfoFailure records a cache whose nix-cache-info couldn't be fetched, so it
+// isn't asked again until its backoff has passed.
+type cacheInfoFailure struct {
+	failures   int
+	retryAfter time.Time
+}
+
+// caches returns the usable caches in the order they should be queried: by
+// priority, then in the order they were configured. The nix-cache-info of each
+// cache is fetched the first time it can be. Caches serving a different store
+// directory are rejected. Caches whose nix-cache-info couldn't be fetched are
+// kept at the default priority, and asked again once a backoff has passed.
+func (fs *nixHttpCacheFs) caches(ctx context.Context) []*url.URL {
+	fs.cacheInfoMu.Lock()
+	if fs.orderedCaches != nil {
+		defer fs.cacheInfoMu.Unlock()
+		return fs.orderedCaches
+	}
+	var pending []*url.URL
+	now := time.Now()
+	for _, cacheUrl := range fs.cacheUrls {
+		if _, found := fs.cacheInfos[cacheUrl]; found {
+			continue
+		}
+		if failure, found := fs.cacheInfoFailures[cacheUrl]; found && now.Before(failure.retryAfter) {
+			continue
+		}
+		pending = append(pending, cacheUrl)
+	}
+	fs.cacheInfoMu.Unlock()
+
+	// Fetch outside the lock so callers only ever wait on their own context.
+	// Caches are asked in order, since the first to answer may decide the store
+	// directory.
+	for _, cacheUrl := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		_, _ = shareFlight(ctx, &fs.cacheInfoFlight, cacheUrl.String(), func(ctx context.Context) (interface{}, error) {
+			return nil, fs.loadCacheInfo(ctx, cacheUrl)
+		})
+	}
+
+	fs.cacheInfoMu.Lock()
+	defer fs.cacheInfoMu.Unlock()
+	if fs.orderedCaches != nil {
+		return fs.orderedCaches
+	}
+
+	ordered := make([]*url.URL, 0, len(fs.cacheUrls))
+	for _, cacheUrl := range fs.cacheUrls {
+		if info, found := fs.cacheInfos[cacheUrl]; !found || info.StoreDir == fs.storeDir {
+			ordered = append(ordered, cacheUrl)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return fs.priority(ordered[i]) < fs.priority(ordered[j])
+	})
+
+	if len(fs.cacheInfos) == len(fs.cacheUrls) {
+		fs.orderedCaches = ordered
+	}
+	return ordered
+}
+
+// loadCacheInfo fetches and records the nix-cache-info of a cache, or records
+// the failure to.
+func (fs *nixHttpCacheFs) loadCacheInfo(ctx context.Context, cacheUrl *url.URL) error {
+	info, err := fs.fetchCacheInfo(ctx, cacheUrl)
+
+	fs.cacheInfoMu.Lock()
+	defer fs.cacheInfoMu.Unlock()
+	if err != nil {
+		// A cancelled request says nothing about the cache.
+		if ctx.Err() != nil {
+			return err
+		}
+		fs.errorLog("nix-cache-info", err)
+		failure, found := fs.cacheInfoFailures[cacheUrl]
+		if !found {
+			failure = &cacheInfoFailure{}
+			fs.cacheInfoFailures[cacheUrl] = failure
+		}
+		failure.retryAfter = time.Now().Add(fs.backoff(failure.failures))
+		failure.failures++
+		return err
+	}
+	delete(fs.cacheInfoFailures, cacheUrl)
+
+	if fs.storeDir == "" {
+		// Without a configured store directory, the first cache we hear from decides it.
+		fs.storeDir = info.StoreDir
+	}
+	if info.StoreDir != fs.storeDir {
+		fs.errorLog("nix-cache-info", fmt.Errorf("%s: rejecting cache serving store directory %s rather than %s",
+			cacheUrl.String(), info.StoreDir, fs.storeDir))
+	}
+	fs.cacheInfos[cacheUrl] = info
+	return nil
+}
+
+// priority returns the priority of a cache. The caller must hold cacheInfoMu.
+func (fs *nixHttpCacheFs) priority(cacheUrl *url.URL) int {
+	if info, found := fs.cacheInfos[cacheUrl]; found {
+		return info.Priority
+	}
+	return defaultPriority
+}
+
+// getStoreDir returns the store directory served by the caches. It is empty until
+// a cache serving it has been reached. Unless it was configured, it is learned from
+// the first cache which can be reached.
+func (fs *nixHttpCacheFs) getStoreDir(ctx context.Context) string {
+	fs.caches(ctx)
+	fs.cacheInfoMu.Lock()
+	defer fs.cacheInfoMu.Unlock()
+	for _, info := range fs.cacheInfos {
+		if info.StoreDir == fs.storeDir {
+			return fs.storeDir
+		}
+	}
+	return ""
+}
@@ -6,12 +6,15 @@ import (
 	"io/fs"
 	"os"
 	"runtime"
+
+	"github.com/spf13/afero"
 )
 
 // cachedFile implements a locally cached file which will be deleted on close.
-// These are constructed by opening the file handle and immediately deleting it.
+// These are constructed by opening the file handle and immediately deleting it,
+// or by opening a NAR kept in the NAR store.
 type cachedFile struct {
-	cached *os.File
+	cached afero.File
 }
 
 // NewCacheFile instantiates a cache file which will be pre-deleted after being opened,
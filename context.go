@@ -0,0 +1,66 @@
+package nix_http_cachefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/spf13/afero"
+	"golang.org/x/sync/singleflight"
+)
+
+// ContextFs is an afero.Fs whose operations can also be given a context. The
+// context cancels any requests to the binary caches, and any NAR download, the
+// operation makes. It only covers the operation itself: reading from a file after
+// it has been opened is not bound by the context it was opened with.
+type ContextFs interface {
+	afero.Fs
+	OpenContext(ctx context.Context, name string) (afero.File, error)
+	OpenFileContext(ctx context.Context, name string, flag int, perm os.FileMode) (afero.File, error)
+	StatContext(ctx context.Context, name string) (os.FileInfo, error)
+	LstatContext(ctx context.Context, name string) (os.FileInfo, error)
+	ReadlinkContext(ctx context.Context, name string) (string, error)
+}
+
+// contextReader fails reads once its context is done. Responses replayed from the
+// persistent cache are local files, which the request context doesn't interrupt.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// isContextErr reports whether err is the result of a context being done.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// shareFlight calls fn through group, so concurrent calls for the same key share a
+// single fetch. The fetch runs with the context of the caller which started it, but
+// every caller stops waiting when its own context is done. A caller whose context is
+// still live retries if the shared fetch was cancelled by someone else's.
+func shareFlight(ctx context.Context, group *singleflight.Group, key string,
+	fn func(ctx context.Context) (interface{}, error),
+) (interface{}, error) {
+	for {
+		ch := group.DoChan(key, func() (interface{}, error) {
+			return fn(ctx)
+		})
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case result := <-ch:
+			if result.Err != nil && result.Shared && ctx.Err() == nil && isContextErr(result.Err) {
+				continue
+			}
+			return result.Val, result.Err
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package nix_http_cachefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The kinds of failure a request to a binary cache can have, which can be tested
+// for with errors.Is. The filesystem itself reports ErrNotFound and ErrUnauthorized
+// as plain fs.ErrNotExist and fs.ErrPermission.
+var (
+	// ErrNotFound means the cache doesn't have the requested file.
+	ErrNotFound = fmt.Errorf("not found on binary cache: %w", iofs.ErrNotExist)
+	// ErrUnauthorized means the cache refused our credentials.
+	ErrUnauthorized = fmt.Errorf("not authorized by binary cache: %w", iofs.ErrPermission)
+	// ErrTransient means the cache couldn't be reached or failed to answer. Trying
+	// again later may succeed.
+	ErrTransient = errors.New("binary cache unavailable")
+	// ErrCorrupt means the cache served data which couldn't be parsed or verified.
+	ErrCorrupt = errors.New("corrupt data from binary cache")
+)
+
+// CacheError is a failed request to a single binary cache.
+type CacheError struct {
+	URL string
+	// Kind is one of ErrNotFound, ErrUnauthorized, ErrTransient or ErrCorrupt.
+	Kind error
+	// Err is the underlying error, if any.
+	Err error
+}
+
+func (e *CacheError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %v", e.URL, e.Kind)
+	}
+	return fmt.Sprintf("%s: %v: %v", e.URL, e.Kind, e.Err)
+}
+
+func (e *CacheError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// LookupError is the failure of every cache tried for a request.
+type LookupError struct {
+	// Kind is the most actionable kind of the failures: it is only ErrNotFound if
+	// every cache reported the file missing.
+	Kind error
+	// Errs are the failures of each cache, usually CacheErrors.
+	Errs []error
+}
+
+func (e *LookupError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%v: %s", e.Kind, strings.Join(msgs, "; "))
+}
+
+// Unwrap only exposes the overall kind. The failures of individual caches are
+// not unwrapped, since one cache not having a file doesn't mean it doesn't exist.
+func (e *LookupError) Unwrap() error {
+	return e.Kind
+}
+
+// errorKinds are the failure kinds from most to least actionable.
+var errorKinds = []error{ErrTransient, ErrCorrupt, ErrUnauthorized, ErrNotFound} //nolint:gochecknoglobals
+
+// newLookupError combines the failures of every cache tried for a request.
+func newLookupError(errs []error) error {
+	if len(errs) == 0 {
+		return &LookupError{Kind: ErrNotFound}
+	}
+	for _, kind := range errorKinds {
+		for _, err := range errs {
+			if errors.Is(err, kind) {
+				return &LookupError{Kind: kind, Errs: errs}
+			}
+		}
+	}
+	// Errors of no known kind say nothing about whether the file exists, so they
+	// mustn't be reported as not found.
+	return &LookupError{Kind: ErrTransient, Errs: errs}
+}
+
+// statusKind classifies an HTTP response status, returning nil for statuses
+// which aren't failures.
+func statusKind(status int) error {
+	switch {
+	case status >= 200 && status <= 299:
+		return nil
+	case status == http.StatusNotFound || status == http.StatusGone:
+		return ErrNotFound
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrUnauthorized
+	default:
+		return ErrTransient
+	}
+}
+
+// readKind classifies an error reading a response body. Network failures are
+// transient; anything else means the body couldn't be decoded.
+func readKind(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTransient
+	}
+	return ErrCorrupt
+}
+
+// pathError wraps err for return from the public API. Missing files and permission
+// failures are reduced to the io/fs sentinels, since os.IsNotExist and
+// os.IsPermission don't unwrap error chains.
+func pathError(op, name string, err error) error {
+	// Don't nest PathErrors, e.g. from opening a file inside a NAR.
+	if pathErr, ok := err.(*iofs.PathError); ok { //nolint:errorlint
+		err = pathErr.Err
+	}
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		err = iofs.ErrNotExist
+	case errors.Is(err, iofs.ErrPermission):
+		err = iofs.ErrPermission
+	}
+	return &iofs.PathError{Op: op, Path: name, Err: err}
+}
+
+// linkError is pathError for operations on two names, such as rename.
+func linkError(op, oldname, newname string, err error) error {
+	// Don't nest LinkErrors, e.g. from renaming in the staging area.
+	if linkErr, ok := err.(*os.LinkError); ok { //nolint:errorlint
+		err = linkErr.Err
+	}
+	reduced := pathError(op, oldname, err).(*iofs.PathError) //nolint:errorlint,forcetypeassert
+	return &os.LinkError{Op: op, Old: oldname, New: newname, Err: reduced.Err}
+}
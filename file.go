@@ -4,6 +4,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"sync"
 	"syscall"
 
 	"github.com/samber/lo"
@@ -12,10 +13,19 @@ import (
 type narchivedFile struct {
 	handle fs.File
 	name   string
+	// shared is the NAR this file was opened from, if any. It is released on close.
+	shared    *sharedNar
+	closeOnce sync.Once
 }
 
 func (f *narchivedFile) Close() error {
-	return f.handle.Close()
+	err := f.handle.Close()
+	f.closeOnce.Do(func() {
+		if f.shared != nil {
+			f.shared.release()
+		}
+	})
+	return err
 }
 
 func (f *narchivedFile) Read(p []byte) (n int, err error) {
@@ -63,6 +73,16 @@ func (f *narchivedFile) Readdir(count int) ([]os.FileInfo, error) {
 	}), nil
 }
 
+// ReadDir implements fs.ReadDirFile. Unlike Readdir the entries are not stat'd,
+// which for the store directory would mean fetching every narinfo.
+func (f *narchivedFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	readDirrer, ok := f.handle.(fs.ReadDirFile)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	return readDirrer.ReadDir(count)
+}
+
 func (f *narchivedFile) Readdirnames(n int) ([]string, error) {
 	readDirrer, ok := f.handle.(fs.ReadDirFile)
 	if !ok {
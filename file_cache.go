@@ -0,0 +1,188 @@
+package nix_http_cachefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+)
+
+// fileScheme is the URL scheme of binary caches in a local directory, such as those
+// written by nix copy --to file://...
+const fileScheme = "file"
+
+// checkFileUrl checks a file:// cache URL refers to a local directory.
+func checkFileUrl(u *url.URL) error {
+	if u.Host != "" && u.Host != "localhost" {
+		return fmt.Errorf("file cache URL must be local: %s", u.Redacted())
+	}
+	if u.Path == "" {
+		return fmt.Errorf("file cache URL has no path: %s", u.Redacted())
+	}
+	return nil
+}
+
+// fileRoundTripper serves file:// URLs directly from disk, answering requests as a
+// binary cache served over HTTP would: GET and HEAD requests with Range support,
+// and PUT requests which write the file. Requests for any other URL are passed
+// through unchanged.
+type fileRoundTripper struct {
+	http.RoundTripper
+}
+
+func (t *fileRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme != fileScheme {
+		return t.RoundTripper.RoundTrip(request)
+	}
+	if err := checkFileUrl(request.URL); err != nil {
+		return nil, err
+	}
+	if request.Body != nil {
+		defer request.Body.Close()
+	}
+
+	name := filepath.FromSlash(request.URL.Path)
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		return serveFile(request, name)
+	case http.MethodPut:
+		if err := putFile(name, request.Body); err != nil {
+			return nil, err
+		}
+		return fileResponse(request, http.StatusCreated, nil, 0), nil
+	default:
+		return fileResponse(request, http.StatusMethodNotAllowed, nil, 0), nil
+	}
+}
+
+// fileResponse builds the response to request.
+func fileResponse(request *http.Request, status int, body io.ReadCloser, size int64) *http.Response {
+	if body == nil {
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          body,
+		ContentLength: size,
+		Request:       request,
+	}
+}
+
+// serveFile answers a GET or HEAD request for the file at name.
+func serveFile(request *http.Request, name string) (*http.Response, error) {
+	f, err := os.Open(name)
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		return fileResponse(request, http.StatusNotFound, nil, 0), nil
+	case errors.Is(err, iofs.ErrPermission):
+		return fileResponse(request, http.StatusForbidden, nil, 0), nil
+	case err != nil:
+		return nil, err
+	}
+	finfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Binary caches only serve files.
+	if !finfo.Mode().IsRegular() {
+		f.Close()
+		return fileResponse(request, http.StatusNotFound, nil, 0), nil
+	}
+
+	size := finfo.Size()
+	status := http.StatusOK
+	start, end := int64(0), size
+	if rangeHeader := request.Header.Get("Range"); rangeHeader != "" {
+		var ok bool
+		if start, end, ok = parseRange(rangeHeader, size); !ok {
+			f.Close()
+			resp := fileResponse(request, http.StatusRequestedRangeNotSatisfiable, nil, 0)
+			resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return resp, nil
+		}
+		status = http.StatusPartialContent
+	}
+
+	var body io.ReadCloser = http.NoBody
+	if request.Method == http.MethodGet {
+		body = struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, start, end-start), f}
+	} else {
+		f.Close()
+	}
+	resp := fileResponse(request, status, body, end-start)
+	resp.Header.Set("Content-Length", strconv.FormatInt(end-start, 10))
+	resp.Header.Set("Accept-Ranges", "bytes")
+	if status == http.StatusPartialContent {
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+	return resp, nil
+}
+
+// parseRange parses a Range header for a single range of a file of size into the
+// start and end offsets of the range.
+func parseRange(rangeHeader string, size int64) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(rangeHeader, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// A suffix of the file.
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		return max(size-suffix, 0), size, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size
+	if last != "" {
+		lastByte, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || lastByte < start {
+			return 0, 0, false
+		}
+		end = min(lastByte+1, size)
+	}
+	return start, end, true
+}
+
+// putFile writes body to the file at name, replacing it atomically.
+func putFile(name string, body io.Reader) error {
+	if body == nil {
+		body = http.NoBody
+	}
+	dest := pathlib.NewPath(name, pathlib.PathWithAfero(afero.NewOsFs()))
+	if err := dest.Parent().MkdirAll(); err != nil {
+		return err
+	}
+	if err := writeAtomic(dest, body); err != nil {
+		return err
+	}
+	// Temporary files are private, but the files of a cache are for anyone to read.
+	return os.Chmod(name, 0o644) //nolint:gosec
+}
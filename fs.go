@@ -1,16 +1,19 @@
 package nix_http_cachefs
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	iofs "io/fs"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,17 +22,50 @@ import (
 	"github.com/spf13/afero"
 	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
 	"go.uber.org/multierr"
+	"golang.org/x/sync/singleflight"
 	"zombiezen.com/go/nix/nar"
 )
 
 type nixHttpCacheFs struct {
 	cacheUrls []*url.URL
 	opts      *options
-	storeDir  string
 	client    *http.Client
-	// TODO: cached tracks the number of references to an opened NAR file to avoid redownloading it
-	// TODO: this would also be a good way to assign inode numbers to use with bazil fuse.
-	// cached map[*cachedFile]atomic.Int64
+	// persistentCache is the caching transport in use, if any.
+	persistentCache *CachingRoundTripper
+	// narStore keeps decompressed NARs in the persistent cache, if there is one.
+	narStore *narStore
+
+	// cacheInfoMu protects the nix-cache-info of each cache, and what is derived from them.
+	cacheInfoMu sync.Mutex
+	cacheInfos  map[*url.URL]*cacheInfo
+	// cacheInfoFailures are the caches whose nix-cache-info couldn't be fetched.
+	cacheInfoFailures map[*url.URL]*cacheInfoFailure
+	// cacheInfoFlight coalesces concurrent nix-cache-info requests for the same cache.
+	cacheInfoFlight singleflight.Group
+	// orderedCaches are the usable caches in priority order, once every cache's
+	// nix-cache-info is known.
+	orderedCaches []*url.URL
+	// storeDir is the configured store directory, or else the one of the first cache.
+	storeDir string
+
+	// ninfoFlight coalesces concurrent narinfo requests for the same store path.
+	ninfoFlight singleflight.Group
+	// listingFlight coalesces concurrent .ls listing requests for the same store path.
+	listingFlight singleflight.Group
+	// nars tracks the number of references to an opened NAR file to avoid redownloading it
+	nars *narTable
+	// listings retains NAR metadata after the NARs themselves are released.
+	listings *listingCache
+	// peeks keeps the responses of NARs peeked at, for a download which follows.
+	peeks *peekedNars
+	// knownPaths are the store paths listed in the synthesized store directory.
+	knownPaths *knownStorePaths
+	// misses remembers narinfos which caches reported missing.
+	misses *negativeCache
+	// health skips caches which keep failing.
+	health *cacheHealth
+	// staging holds store paths being written, if the filesystem is writable.
+	staging *staging
 }
 
 // ninfoWithOrigin retains the originating cache of a ninfo file.
@@ -43,14 +79,31 @@ type ninfoWithOrigin struct {
 
 // NewNixHttpCacheFs instantiates a new Nix HTTP Binary Cache filesystem using
 // the given cache URL and netrc file for authentication (credentials can also
-// be supplied in the URL). NixHttpCacheFs filesystems are read-only.
-// TODO: actually they could be writeable with a little magic...
-func NewNixHttpCacheFs(cacheUrls []*url.URL, opt ...Opt) (afero.Fs, error) {
-	opts := &options{}
+// be supplied in the URL). NixHttpCacheFs filesystems are read-only unless the
+// Writable option is given, in which case they also implement Committer.
+func NewNixHttpCacheFs(cacheUrls []*url.URL, opt ...Opt) (ContextFs, error) {
+	opts := &options{
+		narIdleTimeout:    defaultNarIdleTimeout,
+		listingCacheSize:  defaultListingCacheSize,
+		negativeCacheTTL:  defaultNegativeCacheTTL,
+		retries:           defaultRetries,
+		retryBaseDelay:    defaultRetryBaseDelay,
+		retryMaxDelay:     defaultRetryMaxDelay,
+		breakerThreshold:  defaultBreakerThreshold,
+		breakerCooldown:   defaultBreakerCooldown,
+		uploadCompression: defaultUploadCompression,
+	}
 	for _, o := range opt {
 		o(opts)
 	}
 
+	if opts.signNarInfoFiles && opts.signingKey == nil {
+		opts.err = multierr.Append(opts.err, errors.New("signing narinfo files requires a signing key"))
+	}
+	if opts.err != nil {
+		return nil, errors.Join(errors.New("invalid options"), opts.err)
+	}
+
 	if len(cacheUrls) == 0 {
 		return nil, errors.New("must specify at least 1 cache URL")
 	}
@@ -59,25 +112,76 @@ func NewNixHttpCacheFs(cacheUrls []*url.URL, opt ...Opt) (afero.Fs, error) {
 		if cacheUrl == nil {
 			return nil, fmt.Errorf("cache url at position %v is nil - this is invalid", idx)
 		}
+		if cacheUrl.Scheme == fileScheme {
+			if err := checkFileUrl(cacheUrl); err != nil {
+				return nil, err
+			}
+		}
+		if cacheUrl.Scheme == s3Scheme {
+			if _, err := parseS3Bucket(cacheUrl); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	roundTripper := http.DefaultTransport
 	if opts.roundTripper != nil {
 		roundTripper = opts.roundTripper
 	}
+	// s3:// caches are served by rewriting their requests for the bucket endpoint.
+	roundTripper = newS3RoundTripper(roundTripper, opts.s3Credentials)
+	// file:// caches are read from disk.
+	roundTripper = &fileRoundTripper{RoundTripper: roundTripper}
 
+	var persistentCache *CachingRoundTripper
 	if opts.persistentCache != nil {
-		roundTripper = &CachingRoundTripper{
+		persistentCache = &CachingRoundTripper{
 			PersistentCache: opts.persistentCache,
 			RoundTripper:    roundTripper,
+			MaxBytes:        opts.persistentCacheMaxBytes,
+			MaxAge:          opts.persistentCacheMaxAge,
 		}
+		roundTripper = persistentCache
+	}
+	var store *narStore
+	if persistentCache != nil {
+		store = &narStore{cache: persistentCache, verify: opts.requireSigs}
+	}
+
+	cacheFs := &nixHttpCacheFs{
+		cacheUrls:         cacheUrls,
+		cacheInfos:        map[*url.URL]*cacheInfo{},
+		cacheInfoFailures: map[*url.URL]*cacheInfoFailure{},
+		storeDir:          opts.storeDir,
+		opts:              opts,
+		client:            &http.Client{Transport: roundTripper},
+		persistentCache:   persistentCache,
+		narStore:          store,
+		nars:              newNarTable(opts.narIdleTimeout),
+		listings:          newListingCache(opts.listingCacheSize),
+		peeks:             newPeekedNars(),
+		knownPaths:        newKnownStorePaths(opts.storePaths),
+		misses:            newNegativeCache(opts.negativeCacheTTL, persistentCache),
+		health:            newCacheHealth(opts.breakerThreshold, opts.breakerCooldown),
+	}
+
+	if opts.writable {
+		stagingDir, err := os.MkdirTemp("", "nix-http-cachefs-staging-*")
+		if err != nil {
+			return nil, errors.Join(errors.New("could not create staging directory"), err)
+		}
+		cacheFs.staging = newStaging(stagingDir)
 	}
 
-	return &nixHttpCacheFs{
-		cacheUrls: cacheUrls,
-		opts:      opts,
-		client:    &http.Client{Transport: roundTripper},
-	}, nil
+	// Expire anything left over from previous runs before it is listed or served.
+	if persistentCache != nil && (persistentCache.MaxBytes > 0 || persistentCache.MaxAge > 0) {
+		if err := persistentCache.Prune(); err != nil {
+			cacheFs.errorLog("persistent cache prune", err)
+		}
+	}
+	cacheFs.scanPersistentCache()
+
+	return cacheFs, nil
 }
 
 func (fs *nixHttpCacheFs) debugLog(msg string, values ...string) {
@@ -97,43 +201,13 @@ func (fs *nixHttpCacheFs) errorLog(msg string, e error) {
 	}
 }
 
-// getStoreDir retrieves the store directory from the cache if it is not already known.
-// This function will only use the *first* configured cacheUrl - it's a mistake to configure
-// multiple conflicting ones.
-func (fs *nixHttpCacheFs) getStoreDir() string {
-	if fs.storeDir == "" {
-		req, err := fs.newRequest(http.MethodGet, fs.cacheUrls[0].JoinPath("nix-cache-info").String(), nil)
-		if err != nil {
-			return fs.storeDir
-		}
-		resp, err := fs.client.Do(req)
-		if err != nil {
-			return fs.storeDir
-		}
-		// TODO: move into nix-sigman as a type
-		defer resp.Body.Close()
-		bio := bufio.NewScanner(resp.Body)
-		for bio.Scan() {
-			fieldName, fieldValue, found := strings.Cut(bio.Text(), ":")
-			if !found {
-				continue
-			}
-			if fieldName == "StoreDir" {
-				fs.storeDir = strings.TrimSpace(fieldValue)
-				break
-			}
-		}
-	}
-	return fs.storeDir
-}
-
-func (fs *nixHttpCacheFs) newRequest(method, uri string, body io.Reader) (*http.Request, error) {
+func (fs *nixHttpCacheFs) newRequest(ctx context.Context, method, uri string, body io.Reader) (*http.Request, error) {
 	parsed, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(method, uri, nil)
+	req, err := http.NewRequestWithContext(ctx, method, uri, body)
 	if err != nil {
 		return nil, err
 	}
@@ -148,80 +222,224 @@ func (fs *nixHttpCacheFs) newRequest(method, uri string, body io.Reader) (*http.
 }
 
 // getNarInfo retrieves a narinfo file for the given store path.
-func (fs *nixHttpCacheFs) getNarInfo(name string) (*ninfoWithOrigin, error) {
+func (fs *nixHttpCacheFs) getNarInfo(ctx context.Context, name string) (*ninfoWithOrigin, error) {
 	fs.debugLog("getNarInfo", name)
 	withErr := func(e error) (*ninfoWithOrigin, error) {
-		fs.errorLog("getNarInfo", e)
+		// Missing store paths are routine, e.g. when probing a closure.
+		if errors.Is(e, iofs.ErrNotExist) {
+			fs.debugLog("getNarInfo", e.Error())
+		} else {
+			fs.errorLog("getNarInfo", e)
+		}
 		return nil, e
 	}
 
 	// Remove the store path from the name
-	narPathWithoutPrefix, _ := strings.CutPrefix(name, fs.getStoreDir())
+	narPathWithoutPrefix, _ := strings.CutPrefix(name, fs.getStoreDir(ctx))
 	// Remove any nested paths
 	splitPath := strings.Split(narPathWithoutPrefix, string(os.PathSeparator))
 	if len(splitPath) < 2 {
-		return withErr(errors.New("name is not valid"))
+		if err := ctx.Err(); err != nil {
+			return withErr(err)
+		}
+		// Nothing outside the store directory exists.
+		return withErr(iofs.ErrNotExist)
 	}
 
 	// Split the last part of the path to determine if it's a narinfo
 	pathExtComponents := strings.Split(splitPath[1], ".")
 	pathExt, hasExt := lo.Last(pathExtComponents)
+	isNinfoPath := lo.Ternary(hasExt, pathExt == "narinfo", false)
+
 	// Cut the first part of the path to get what should be the narHash
 	shortPath, _, _ := strings.Cut(splitPath[1], "-")
+	if isNinfoPath {
+		shortPath = strings.TrimSuffix(shortPath, ".narinfo")
+	}
+
+	// Concurrent lookups of the same store path share a single fetch.
+	fetched, err := shareFlight(ctx, &fs.ninfoFlight, shortPath, func(ctx context.Context) (interface{}, error) {
+		return fs.fetchNarInfo(ctx, shortPath)
+	})
+	if err != nil {
+		return withErr(err)
+	}
+
+	// The fetched narinfo is shared, but the origin wrapper is per-caller.
+	result := *(fetched.(*ninfoWithOrigin))
+	result.pathIsNinfo = isNinfoPath
+	return &result, nil
+}
 
+// fetchNarInfo requests the narinfo for the given store path hash from the configured caches.
+func (fs *nixHttpCacheFs) fetchNarInfo(ctx context.Context, shortPath string) (*ninfoWithOrigin, error) {
 	// Try every configured cache before failing
 	var result *ninfoWithOrigin
-	var errs error
-	isNinfoPath := lo.Ternary(hasExt, pathExt == "narinfo", false)
+	var errs []error
 
-	for _, cacheUrl := range fs.cacheUrls {
-		var ninfoUrl string
-		ninfoUrl = cacheUrl.JoinPath(fmt.Sprintf("%s.narinfo", shortPath)).String()
+	for _, cacheUrl := range fs.caches(ctx) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ninfoUrl := cacheUrl.JoinPath(fmt.Sprintf("%s.narinfo", shortPath))
+		cacheErr := func(kind error, err error) {
+			errs = append(errs, &CacheError{URL: ninfoUrl.String(), Kind: kind, Err: err})
+		}
 
-		fs.debugLog("HTTP Request", http.MethodGet, ninfoUrl)
+		if fs.misses.isMissing(ninfoUrl) {
+			fs.debugLog("Known missing", ninfoUrl.String())
+			cacheErr(ErrNotFound, nil)
+			continue
+		}
+
+		fs.debugLog("HTTP Request", http.MethodGet, ninfoUrl.String())
 
 		// request the narinfo from the disk
-		req, err := fs.newRequest(http.MethodGet, ninfoUrl, nil)
+		response, err := fs.get(ctx, cacheUrl, ninfoUrl.String(), nil)
 		if err != nil {
-			errs = multierr.Append(errs, err)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			cacheErr(ErrTransient, err)
 			continue
 		}
 
-		response, err := fs.client.Do(req)
-		if err != nil {
-			errs = multierr.Append(errs, err)
+		if kind := statusKind(response.StatusCode); kind != nil {
+			response.Body.Close()
+			if kind == ErrNotFound {
+				if err := fs.misses.addMissing(ninfoUrl); err != nil {
+					fs.errorLog("negative cache", err)
+				}
+			}
+			cacheErr(kind, errors.New(response.Status))
 			continue
 		}
 
 		defer response.Body.Close()
 		ninfoResponse, err := io.ReadAll(response.Body)
 		if err != nil {
-			errs = multierr.Append(errs, err)
+			cacheErr(readKind(err), err)
 			continue
 		}
 
 		ninfo := new(nixtypes.NarInfo)
 		if err := ninfo.UnmarshalText(ninfoResponse); err != nil {
-			errs = multierr.Append(errs, err)
+			cacheErr(ErrCorrupt, err)
+			continue
+		}
+
+		if err := fs.verifyNarInfo(shortPath, ninfo); err != nil {
+			cacheErr(ErrCorrupt, err)
 			continue
 		}
 		result = &ninfoWithOrigin{
-			cacheUrl:    cacheUrl,
-			ninfo:       ninfo,
-			pathIsNinfo: isNinfoPath,
+			cacheUrl: cacheUrl,
+			ninfo:    ninfo,
 		}
+		fs.knownPaths.addNarInfo(ninfo)
+		// Caches are in priority order, so the first to have the narinfo wins.
+		break
 	}
 
 	if result == nil {
-		// If we failed then return the complete multi-err for all our attempts
-		return withErr(multierr.Append(errs, errors.New("no cache URL succeeded")))
+		// If we failed then return the failures of every cache we tried
+		return nil, newLookupError(errs)
 	}
 
 	return result, nil
 }
 
+// verifyNarInfo checks a narinfo is for the requested store path hash and, if trusted
+// keys are configured, that it carries at least one valid signature from them.
+func (fs *nixHttpCacheFs) verifyNarInfo(shortPath string, ninfo *nixtypes.NarInfo) error {
+	if !strings.HasPrefix(path.Base(ninfo.StorePath), shortPath+"-") {
+		return fmt.Errorf("narinfo is for the wrong store path: %s", ninfo.StorePath)
+	}
+
+	if !fs.opts.requireSigs {
+		return nil
+	}
+
+	for _, key := range fs.opts.trustedKeys {
+		if ok, _ := ninfo.Verify(key); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("narinfo for %s has no valid signature from a trusted key", ninfo.StorePath)
+}
+
+// signNarInfo returns a copy of ninfo signed with the signing key, replacing any
+// signature it already had from that key. ninfo itself is not modified, since
+// narinfos are shared between callers.
+func (fs *nixHttpCacheFs) signNarInfo(ninfo *nixtypes.NarInfo) (*nixtypes.NarInfo, error) {
+	signed := *ninfo
+	signed.Sig = slices.Clone(ninfo.Sig)
+	if _, _, err := signed.SignReplaceByName(*fs.opts.signingKey); err != nil {
+		return nil, fmt.Errorf("signing narinfo for %s: %w", ninfo.StorePath, err)
+	}
+	return &signed, nil
+}
+
+// decompressorFor returns the decompressor for a narinfo Compression value, or nil
+// if the NAR is stored uncompressed.
+func decompressorFor(compression string) archives.Decompressor {
+	switch compression {
+	case "xz":
+		return new(archives.Xz)
+	case "bzip2":
+		return new(archives.Bz2)
+	case "gzip":
+		return new(archives.Gz)
+	case "zstd":
+		return new(archives.Zstd)
+	case "br":
+		return new(archives.Brotli)
+	case "lz4":
+		return new(archives.Lz4)
+	case "lzip":
+		return new(archives.Lzip)
+	}
+	return nil
+}
+
+// evictPersistent drops a download which failed verification from the persistent
+// cache, so it is fetched again rather than served forever after.
+func (fs *nixHttpCacheFs) evictPersistent(u *url.URL) {
+	if fs.persistentCache == nil {
+		return
+	}
+	if err := fs.persistentCache.Evict(u); err != nil {
+		fs.errorLog("evictPersistent", err)
+	}
+}
+
+// resolveCacheUrl resolves ref, such as the URL of a NAR, against cacheUrl. The
+// cache URL is a directory whether or not it ends in a slash, as it is to nix. The
+// query of the cache URL, which locates the bucket of an s3:// cache, is kept.
+// References off the cache are refused: the transport reads file:// URLs from disk
+// and signs s3:// ones, which a narinfo from a remote cache mustn't be able to make
+// it do. Local caches are confined to their directory for the same reason.
+func resolveCacheUrl(cacheUrl *url.URL, ref *url.URL) (*url.URL, error) {
+	base := *cacheUrl
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+		if base.RawPath != "" {
+			base.RawPath += "/"
+		}
+	}
+	resolved := base.ResolveReference(ref)
+	if resolved.Scheme != cacheUrl.Scheme || resolved.Host != cacheUrl.Host ||
+		resolved.Scheme == fileScheme && !strings.HasPrefix(resolved.Path, base.Path) {
+		return nil, fmt.Errorf("%s is not on cache %s", ref.Redacted(), cacheUrl.Redacted())
+	}
+	if resolved.RawQuery == "" {
+		resolved.RawQuery = cacheUrl.RawQuery
+	}
+	return resolved, nil
+}
+
 // getNar makes a nar stored on a binary cache available as a seekable binary file.
-func (fs *nixHttpCacheFs) getNar(ninfo *ninfoWithOrigin) (*cachedFile, error) {
+func (fs *nixHttpCacheFs) getNar(ctx context.Context, ninfo *ninfoWithOrigin) (*cachedFile, error) {
 	fs.debugLog("getNar", ninfo.ninfo.StorePath, ninfo.cacheUrl.String())
 
 	withErr := func(e error) (*cachedFile, error) {
@@ -235,60 +453,127 @@ func (fs *nixHttpCacheFs) getNar(ninfo *ninfoWithOrigin) (*cachedFile, error) {
 	}
 
 	var cacheFile *cachedFile
-	var errs error
-	for _, cacheUrl := range append([]*url.URL{ninfo.cacheUrl}, fs.cacheUrls...) {
-		resolvedUrl := cacheUrl.ResolveReference(narUrl)
-		fs.debugLog("HTTP Request", http.MethodGet, resolvedUrl.String())
-
-		req, err := fs.newRequest(http.MethodGet, resolvedUrl.String(), nil)
+	var errs []error
+	// The cache which served the narinfo is asked first, then the others in order.
+	otherCaches := lo.Without(fs.caches(ctx), ninfo.cacheUrl)
+	for _, cacheUrl := range append([]*url.URL{ninfo.cacheUrl}, otherCaches...) {
+		if err := ctx.Err(); err != nil {
+			return withErr(err)
+		}
+		resolvedUrl, err := resolveCacheUrl(cacheUrl, narUrl)
 		if err != nil {
-			errs = multierr.Append(errs, err)
+			errs = append(errs, &CacheError{URL: narUrl.Redacted(), Kind: ErrCorrupt, Err: err})
 			continue
 		}
+		cacheErr := func(kind error, err error) {
+			errs = append(errs, &CacheError{URL: resolvedUrl.String(), Kind: kind, Err: err})
+		}
 
-		resp, err := fs.client.Do(req)
-		if err != nil {
-			errs = multierr.Append(errs, err)
-			continue
+		// Carry on from a peek at the NAR if there was one, rather than requesting
+		// it again.
+		resp := fs.peeks.claim(resolvedUrl.String())
+		if resp != nil {
+			fs.debugLog("getNar", "continuing from peek", resolvedUrl.String())
+		} else {
+			fs.debugLog("HTTP Request", http.MethodGet, resolvedUrl.String())
+
+			// The NAR store keeps the decompressed NAR, so keeping the compressed one as
+			// well would only waste space.
+			var header http.Header
+			if fs.narStore != nil {
+				header = http.Header{"Cache-Control": {"no-store"}}
+			}
+			resp, err = fs.get(ctx, cacheUrl, resolvedUrl.String(), header)
+			if err != nil {
+				if ctx.Err() != nil {
+					return withErr(ctx.Err())
+				}
+				cacheErr(ErrTransient, err)
+				continue
+			}
 		}
 
 		defer resp.Body.Close()
-		narReader := resp.Body
 
-		// Ensure we decompress the nar into the cache file
-		var compressor archives.Decompressor
-		switch ninfo.ninfo.Compression {
-		case "xz":
-			compressor = new(archives.Xz)
-		case "bzip2":
-			compressor = new(archives.Bz2)
-		case "gzip":
-			compressor = new(archives.Gz)
-		case "zstd":
-			compressor = new(archives.Zstd)
-		case "", "none":
-			compressor = nil
+		// Error pages mustn't be decompressed as though they were NARs.
+		if kind := statusKind(resp.StatusCode); kind != nil {
+			cacheErr(kind, errors.New(resp.Status))
+			continue
 		}
 
-		cacheFile, err = NewCacheFile(path.Base(ninfo.ninfo.StorePath))
+		// Connections dropped partway through the download are resumed.
+		body := fs.resumable(ctx, cacheUrl, resolvedUrl.String(), resp)
+		defer body.Close()
+
+		// The compressed stream is checked against FileHash/FileSize
+		fileVerifier, err := newVerifyingReader(body, "nar file", ninfo.ninfo.FileHash, ninfo.ninfo.FileSize)
 		if err != nil {
-			// If this fails its an entirely local error we won't recover from.
-			return withErr(err)
+			cacheErr(ErrCorrupt, err)
+			continue
 		}
+		var narReader io.Reader = fileVerifier
+
+		// Ensure we decompress the nar into the cache file
+		compressor := decompressorFor(ninfo.ninfo.Compression)
 
 		if compressor != nil {
-			narReader, err = compressor.OpenReader(narReader)
+			decompressed, err := compressor.OpenReader(narReader)
 			if err != nil {
-				errs = multierr.Append(errs, err)
+				cacheErr(readKind(err), err)
 				continue
 			}
-			defer narReader.Close()
+			defer decompressed.Close()
+			narReader = decompressed
+		}
+
+		// ...and the decompressed stream against NarHash/NarSize
+		narVerifier, err := newVerifyingReader(narReader, "nar", ninfo.ninfo.NarHash, ninfo.ninfo.NarSize)
+		if err != nil {
+			cacheErr(ErrCorrupt, err)
+			continue
 		}
 
-		// Copy the nar to the cache file
-		if _, err := io.Copy(cacheFile, narReader); err != nil {
+		cacheFile, err = NewCacheFile(path.Base(ninfo.ninfo.StorePath))
+		if err != nil {
+			// If this fails its an entirely local error we won't recover from.
+			return withErr(err)
+		}
+
+		// Copy the nar to the cache file. The body may be replayed from the persistent
+		// cache, so cancellation is checked as well as relying on the request context.
+		if _, err := io.Copy(cacheFile, &contextReader{ctx: ctx, reader: narVerifier}); err != nil {
+			if ctx.Err() != nil {
+				// Cancelled - the download was fine as far as it got.
+				cacheFile.Close()
+				return withErr(ctx.Err())
+			}
 			// This can be a product of a failed cache server, so we can retry.
-			errs = multierr.Append(errs, err)
+			cacheErr(readKind(err), err)
+			fs.evictPersistent(resolvedUrl)
+			cacheFile.Close()
+			cacheFile = nil
+			continue
+		}
+
+		// Decompressors may stop short of the end of the compressed stream, so drain
+		// it to make sure the file hash covers everything the server sent.
+		if _, err := io.Copy(io.Discard, &contextReader{ctx: ctx, reader: fileVerifier}); err != nil {
+			if ctx.Err() != nil {
+				cacheFile.Close()
+				return withErr(ctx.Err())
+			}
+			cacheErr(readKind(err), err)
+			fs.evictPersistent(resolvedUrl)
+			cacheFile.Close()
+			cacheFile = nil
+			continue
+		}
+
+		if err := multierr.Combine(fileVerifier.Verify(), narVerifier.Verify()); err != nil {
+			// Corrupt or truncated download - throw it away and try the next cache.
+			cacheErr(ErrCorrupt, err)
+			fs.evictPersistent(resolvedUrl)
+			cacheFile.Close()
 			cacheFile = nil
 			continue
 		}
@@ -304,22 +589,100 @@ func (fs *nixHttpCacheFs) getNar(ninfo *ninfoWithOrigin) (*cachedFile, error) {
 	}
 
 	if cacheFile == nil {
-		return withErr(multierr.Append(errs, errors.New("no cache URL succeeded")))
+		return withErr(newLookupError(errs))
 	}
 
 	return cacheFile, nil
 }
 
+// openNar returns the shared, listed NAR for the narinfo - downloading it only if
+// no other handle currently has it open or is already fetching it, and it isn't in
+// the NAR store. The caller must release the result.
+func (fs *nixHttpCacheFs) openNar(ctx context.Context, ninfo *ninfoWithOrigin) (*sharedNar, error) {
+	return fs.nars.open(ctx, ninfo.ninfo.StorePath, func(ctx context.Context) (*cachedFile, *nar.Listing, error) {
+		if fs.narStore != nil {
+			narchive, listing, err := fs.narStore.open(ninfo.ninfo)
+			if err == nil {
+				fs.debugLog("openNar", "from NAR store", ninfo.ninfo.StorePath)
+				fs.listings.addListing(ninfo.ninfo.StorePath, listing)
+				return narchive, listing, nil
+			}
+			if !errors.Is(err, iofs.ErrNotExist) {
+				fs.errorLog("NAR store", err)
+			}
+		}
+
+		narchive, err := fs.getNar(ctx, ninfo)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		listing, err := nar.List(narchive)
+		if err != nil {
+			narchive.Close()
+			return nil, nil, err
+		}
+		fs.listings.addListing(ninfo.ninfo.StorePath, listing)
+
+		if fs.narStore != nil {
+			if err := fs.narStore.add(ninfo.ninfo, narchive, listing); err != nil {
+				fs.errorLog("NAR store", err)
+			}
+		}
+		return narchive, listing, nil
+	})
+}
+
+// openRanged returns a Range request backed handle for a regular file in an
+// uncompressed NAR, or nil if the file can't or shouldn't be served that way.
+// Ranges can't be verified against the NarHash, so they aren't used when
+// signatures are required.
+func (fs *nixHttpCacheFs) openRanged(ninfo *ninfoWithOrigin, within string, node *nar.ListingNode) *rangedFile {
+	if fs.opts.noRangeReads || fs.opts.requireSigs || decompressorFor(ninfo.ninfo.Compression) != nil {
+		return nil
+	}
+	if !node.Mode.IsRegular() || node.ContentOffset == 0 {
+		// A zero offset means the listing didn't record one.
+		return nil
+	}
+	if fs.nars.isOpen(ninfo.ninfo.StorePath) {
+		return nil
+	}
+	narUrl, err := url.Parse(ninfo.ninfo.URL)
+	if err != nil {
+		return nil
+	}
+	resolvedUrl, err := resolveCacheUrl(ninfo.cacheUrl, narUrl)
+	if err != nil {
+		return nil
+	}
+	return newRangedFile(fs, ninfo, within, resolvedUrl.String(), node.FileInfo(), &node.Header)
+}
+
 func (fs *nixHttpCacheFs) Create(name string) (afero.File, error) {
-	return nil, syscall.EPERM
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
 }
 
 func (fs *nixHttpCacheFs) Mkdir(name string, perm os.FileMode) error {
-	return syscall.EPERM
+	_, stagedName, err := fs.stage(context.Background(), name)
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	if err := fs.staging.fs.Mkdir(stagedName, perm); err != nil {
+		return pathError("mkdir", name, err)
+	}
+	return nil
 }
 
 func (fs *nixHttpCacheFs) MkdirAll(path string, perm os.FileMode) error {
-	return syscall.EPERM
+	_, stagedName, err := fs.stage(context.Background(), path)
+	if err != nil {
+		return pathError("mkdir", path, err)
+	}
+	if err := fs.staging.fs.MkdirAll(stagedName, perm); err != nil {
+		return pathError("mkdir", path, err)
+	}
+	return nil
 }
 
 func (fs *nixHttpCacheFs) Open(name string) (afero.File, error) {
@@ -327,24 +690,63 @@ func (fs *nixHttpCacheFs) Open(name string) (afero.File, error) {
 }
 
 func (fs *nixHttpCacheFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return fs.OpenFileContext(context.Background(), name, flag, perm)
+}
+
+// OpenContext implements ContextFs.
+func (fs *nixHttpCacheFs) OpenContext(ctx context.Context, name string) (afero.File, error) {
+	return fs.OpenFileContext(ctx, name, os.O_RDONLY, os.FileMode(777))
+}
+
+// OpenFileContext implements ContextFs.
+func (fs *nixHttpCacheFs) OpenFileContext(ctx context.Context, name string, flag int, perm os.FileMode) (afero.File, error) {
 	withErr := func(e error) (afero.File, error) {
-		fs.errorLog("OpenFile", e)
-		return nil, e
+		if !errors.Is(e, iofs.ErrNotExist) {
+			fs.errorLog("OpenFile", e)
+		}
+		return nil, pathError("open", name, e)
 	}
-	// Open the narInfo file
-	ninfo, err := fs.getNarInfo(name)
-	if err != nil {
-		return withErr(err)
+
+	// Store paths being written are served from the staging area, and writing
+	// starts a new one.
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		if _, _, err := fs.stage(ctx, name); err != nil {
+			return withErr(err)
+		}
 	}
+	if base, stagedName, ok := fs.staged(ctx, name); ok {
+		fh, err := fs.openStaged(ctx, base, stagedName, flag, perm)
+		if err != nil {
+			return withErr(err)
+		}
+		return fh, nil
+	}
+
+	// Binary caches can't be listed, so the store directory is synthesized from
+	// the store paths we know about.
+	if fs.isStoreDir(ctx, name) {
+		return &narchivedFile{handle: newStoreDirFile(ctx, fs), name: name}, nil
+	}
+
 	// If the file is literally a .narinfo file, then allow opening that directly since a real
 	// binary cache can serve that, and it doesn't harm users at all since it's unambiguous.
-	if ninfo.pathIsNinfo {
+	if fs.isNarInfoName(ctx, name) {
+		ninfo, err := fs.getNarInfo(ctx, name)
+		if err != nil {
+			return withErr(err)
+		}
 		// Return the narinfo file content as a virtual file
 		fh, err := NewCacheFile(path.Base(ninfo.ninfo.StorePath) + ".narinfo")
 		if err != nil {
 			return withErr(err)
 		}
-		ninfoBytes, err := ninfo.ninfo.MarshalText()
+		served := ninfo.ninfo
+		if fs.opts.signNarInfoFiles {
+			if served, err = fs.signNarInfo(served); err != nil {
+				return withErr(err)
+			}
+		}
+		ninfoBytes, err := served.MarshalText()
 		if err != nil {
 			return withErr(err)
 		}
@@ -354,78 +756,257 @@ func (fs *nixHttpCacheFs) OpenFile(name string, flag int, perm os.FileMode) (afe
 		if _, err := fh.Seek(0, io.SeekStart); err != nil {
 			return withErr(err)
 		}
-		return &narchivedFile{handle: fh}, nil
+		return &narchivedFile{handle: fh, name: name}, nil
 	}
 
-	// Open the narchive
-	narchive, err := fs.getNar(ninfo)
+	// Resolve symlinks - possibly into other store paths - down to the real object.
+	// The resolver keeps any NAR it opened referenced so it is reused below.
+	r := fs.newResolver(ctx)
+	defer r.release()
+	resolved, err := r.resolve(name, true)
 	if err != nil {
 		return withErr(err)
 	}
 
-	// Get a listing
-	listing, err := nar.List(narchive)
+	// Directories can be served from a listing alone, without downloading the NAR.
+	if resolved.node.Mode.IsDir() {
+		listing := resolved.listing
+		if listing == nil {
+			if listing, _, err = r.listing(resolved.storePath); err != nil {
+				return withErr(err)
+			}
+		}
+		narfs, err := nar.NewFS(nil, listing)
+		if err != nil {
+			return withErr(err)
+		}
+		fh, err := narfs.Open(resolved.within)
+		if err != nil {
+			return withErr(err)
+		}
+		if resolved.within == "." {
+			finfo, err := r.fileInfo(resolved)
+			if err != nil {
+				return withErr(err)
+			}
+			return &narchivedFile{handle: &namedDir{ReadDirFile: fh.(iofs.ReadDirFile), finfo: finfo}, name: name}, nil
+		}
+		return &narchivedFile{handle: fh, name: name}, nil
+	}
+
+	ninfo, err := r.narInfo(resolved)
 	if err != nil {
 		return withErr(err)
 	}
 
-	// Resolve the name within the archive, if any.
-	nameWithinArchive, _ := strings.CutPrefix(name, ninfo.ninfo.StorePath)
-	// Might be a drv file in which case the above removal doesn't actually fully remove it.
-	//nameWithinArchive, _ = strings.CutPrefix(nameWithinArchive, ".drv")
-	nameWithinArchive, _ = strings.CutPrefix(nameWithinArchive, "/")
-	if nameWithinArchive == "" {
-		nameWithinArchive = "." // this is a quirk of the filename handling
+	// Uncompressed NARs can serve a single file with Range requests, unless
+	// we already have the whole NAR locally.
+	if fh := fs.openRanged(ninfo, resolved.within, resolved.node); fh != nil {
+		return &narchivedFile{handle: fh, name: name}, nil
+	}
+
+	// Open the narchive
+	shared, err := fs.openNar(ctx, ninfo)
+	if err != nil {
+		return withErr(err)
 	}
 
 	// The upstream library implements an FS for us...but returns a private
 	// file type and an iofs public type, which means we don't have enough
 	// methods to support afero like we'd like to.
-	narfs, err := nar.NewFS(narchive, listing)
+	narfs, err := nar.NewFS(shared.file, shared.listing)
 	if err != nil {
+		shared.release()
 		return withErr(err)
 	}
-	fh, err := narfs.Open(nameWithinArchive)
+	fh, err := narfs.Open(resolved.within)
 	if err != nil {
-		return nil, err
+		shared.release()
+		return withErr(err)
 	}
-	return &narchivedFile{handle: fh}, nil
+	return &narchivedFile{handle: fh, name: name, shared: shared}, nil
 }
 
+// Remove removes a file from a store path being written. Removing the store path
+// itself abandons it.
 func (fs *nixHttpCacheFs) Remove(name string) error {
-	return syscall.EPERM
+	base, stagedName, ok := fs.staged(context.Background(), name)
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+	}
+	if err := fs.staging.fs.Remove(stagedName); err != nil {
+		return pathError("remove", name, err)
+	}
+	fs.unstage(base)
+	return nil
 }
 
 func (fs *nixHttpCacheFs) RemoveAll(path string) error {
-	return syscall.EPERM
+	base, stagedName, ok := fs.staged(context.Background(), path)
+	if !ok {
+		return &os.PathError{Op: "removeall", Path: path, Err: syscall.EPERM}
+	}
+	if err := fs.staging.fs.RemoveAll(stagedName); err != nil {
+		return pathError("removeall", path, err)
+	}
+	fs.unstage(base)
+	return nil
 }
 
+// Rename renames files within store paths being written.
 func (fs *nixHttpCacheFs) Rename(oldname, newname string) error {
-	return syscall.EPERM
+	oldBase, oldStaged, ok := fs.staged(context.Background(), oldname)
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	_, newStaged, err := fs.stage(context.Background(), newname)
+	if err != nil {
+		return linkError("rename", oldname, newname, err)
+	}
+	if err := fs.staging.fs.Rename(oldStaged, newStaged); err != nil {
+		return linkError("rename", oldname, newname, err)
+	}
+	fs.unstage(oldBase)
+	return nil
 }
 
 func (fs *nixHttpCacheFs) Stat(name string) (os.FileInfo, error) {
 	// Stat is reasonably complicated to do because we have to unpack the actual
-	// nar file to know what we're stating. So let Open handle it.
-	fh, err := fs.Open(name)
+	// nar file to know what we're stating. The resolver avoids that wherever a
+	// listing or the start of the NAR can answer the question.
+	return fs.stat(context.Background(), name, true)
+}
+
+// StatContext implements ContextFs.
+func (fs *nixHttpCacheFs) StatContext(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.stat(ctx, name, true)
+}
+
+// LstatIfPossible implements afero.Lstater. Symlinks are reported rather than followed.
+func (fs *nixHttpCacheFs) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	finfo, err := fs.stat(context.Background(), name, false)
+	return finfo, true, err
+}
+
+// LstatContext implements ContextFs.
+func (fs *nixHttpCacheFs) LstatContext(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.stat(ctx, name, false)
+}
+
+func (fs *nixHttpCacheFs) stat(ctx context.Context, name string, followLast bool) (os.FileInfo, error) {
+	if fs.isStoreDir(ctx, name) {
+		return &storeDirInfo{name: path.Base(name)}, nil
+	}
+
+	op := lo.Ternary(followLast, "stat", "lstat")
+
+	if _, stagedName, ok := fs.staged(ctx, name); ok {
+		var finfo os.FileInfo
+		var err error
+		if followLast {
+			finfo, err = fs.staging.fs.Stat(stagedName)
+		} else {
+			finfo, _, err = fs.staging.fs.(afero.Lstater).LstatIfPossible(stagedName)
+		}
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+		return finfo, nil
+	}
+
+	if fs.isNarInfoName(ctx, name) {
+		fh, err := fs.OpenContext(ctx, name)
+		if err != nil {
+			return nil, pathError(op, name, err)
+		}
+		defer fh.Close()
+		return fh.Stat()
+	}
+
+	r := fs.newResolver(ctx)
+	defer r.release()
+	resolved, err := r.resolve(name, followLast)
 	if err != nil {
-		return nil, err
+		return nil, pathError(op, name, err)
+	}
+	finfo, err := r.fileInfo(resolved)
+	if err != nil {
+		return nil, pathError(op, name, err)
 	}
-	return fh.Stat()
+	return finfo, nil
+}
+
+// ReadlinkIfPossible implements afero.LinkReader.
+func (fs *nixHttpCacheFs) ReadlinkIfPossible(name string) (string, error) {
+	return fs.ReadlinkContext(context.Background(), name)
+}
+
+// ReadlinkContext implements ContextFs.
+func (fs *nixHttpCacheFs) ReadlinkContext(ctx context.Context, name string) (string, error) {
+	if _, stagedName, ok := fs.staged(ctx, name); ok {
+		target, err := fs.staging.readlink(stagedName)
+		if err != nil {
+			return "", pathError("readlink", name, err)
+		}
+		return target, nil
+	}
+
+	r := fs.newResolver(ctx)
+	defer r.release()
+	resolved, err := r.resolve(name, false)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	if resolved.node.Mode.Type() != os.ModeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return resolved.node.LinkTarget, nil
+}
+
+// SymlinkIfPossible implements afero.Linker. Symlinks can only be created in store
+// paths being written.
+func (fs *nixHttpCacheFs) SymlinkIfPossible(oldname, newname string) error {
+	_, stagedName, err := fs.stage(context.Background(), newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if err := fs.staging.symlink(oldname, stagedName); err != nil {
+		return linkError("symlink", oldname, newname, err)
+	}
+	return nil
 }
 
 func (fs *nixHttpCacheFs) Name() string {
 	return "nix-http-cache-fs"
 }
 
+// Chmod changes the mode of a file in a store path being written. NARs only record
+// whether files are executable.
 func (fs *nixHttpCacheFs) Chmod(name string, mode os.FileMode) error {
-	return syscall.EPERM
+	_, stagedName, ok := fs.staged(context.Background(), name)
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+	}
+	if err := fs.staging.fs.Chmod(stagedName, mode); err != nil {
+		return pathError("chmod", name, err)
+	}
+	return nil
 }
 
+// Chown is accepted for files in store paths being written, but has no effect
+// since NARs don't record ownership.
 func (fs *nixHttpCacheFs) Chown(name string, uid, gid int) error {
-	return syscall.EPERM
+	if _, _, ok := fs.staged(context.Background(), name); !ok {
+		return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+	}
+	return nil
 }
 
+// Chtimes is accepted for files in store paths being written, but has no effect
+// since NARs don't record times.
 func (fs *nixHttpCacheFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	return syscall.EPERM
+	if _, _, ok := fs.staged(context.Background(), name); !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+	}
+	return nil
 }
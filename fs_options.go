@@ -1,10 +1,15 @@
 package nix_http_cachefs
 
 import (
+	"fmt"
 	"net/http"
+	"path"
+	"time"
 
 	"github.com/chigopher/pathlib"
 	"github.com/jdxcode/netrc"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"go.uber.org/multierr"
 )
 
 type options struct {
@@ -13,6 +18,34 @@ type options struct {
 	debugFn         func(msg string)
 	roundTripper    http.RoundTripper
 	persistentCache *pathlib.Path
+	// persistentCacheMaxBytes and persistentCacheMaxAge bound the persistent cache.
+	persistentCacheMaxBytes int64
+	persistentCacheMaxAge   time.Duration
+	trustedKeys             []nixtypes.NamedPublicKey
+	// requireSigs is set whenever trusted keys were requested, even if none
+	// of them parsed, so a typo can't silently disable verification.
+	requireSigs      bool
+	narIdleTimeout   time.Duration
+	listingCacheSize int
+	negativeCacheTTL time.Duration
+	noRangeReads     bool
+	retries          int
+	retryBaseDelay   time.Duration
+	retryMaxDelay    time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	storePaths       []string
+	storeDir         string
+	// writable enables uploading store paths written to the filesystem.
+	writable          bool
+	uploadCompression string
+	// signingKey signs the narinfos of uploaded store paths, and of the .narinfo
+	// files OpenFile returns if signNarInfoFiles is set.
+	signingKey       *nixtypes.NamedPrivateKey
+	signNarInfoFiles bool
+	s3Credentials    *s3Credentials
+	// err accumulates option errors which must be surfaced by the constructor.
+	err error
 }
 
 type Opt func(opt *options)
@@ -45,6 +78,168 @@ func Netrc(netrcContent string) Opt {
 	}
 }
 
+// TrustedPublicKeys specifies a list of name:base64key public keys. When set, any
+// narinfo which does not carry a valid signature from one of these keys is
+// rejected and the next cache URL is tried.
+func TrustedPublicKeys(keys ...string) Opt {
+	return func(opt *options) {
+		opt.requireSigs = true
+		for _, key := range keys {
+			parsed := nixtypes.NamedPublicKey{}
+			if err := parsed.UnmarshalText([]byte(key)); err != nil {
+				opt.err = multierr.Append(opt.err, err)
+				continue
+			}
+			opt.trustedKeys = append(opt.trustedKeys, parsed)
+		}
+	}
+}
+
+// NarIdleTimeout sets how long an opened NAR is kept in memory after its last
+// handle is closed. A zero duration releases NARs as soon as they are unused.
+func NarIdleTimeout(timeout time.Duration) Opt {
+	return func(opt *options) {
+		opt.narIdleTimeout = timeout
+	}
+}
+
+// ListingCacheSize sets how many NAR listings are retained in memory to answer
+// Stat and directory queries without downloading NARs again.
+func ListingCacheSize(size int) Opt {
+	return func(opt *options) {
+		opt.listingCacheSize = size
+	}
+}
+
+// NegativeCacheTTL sets how long a narinfo which a cache reported missing is
+// assumed to stay missing, rather than asking the cache again. Misses are also
+// recorded in the persistent cache, if there is one. A zero duration disables
+// negative caching.
+func NegativeCacheTTL(ttl time.Duration) Opt {
+	return func(opt *options) {
+		opt.negativeCacheTTL = ttl
+	}
+}
+
+// DisableRangeReads stops files in uncompressed NARs being read with HTTP Range
+// requests. Range reads can't be checked against the NarHash, so this ensures all
+// content comes from a fully verified NAR. They are always disabled when
+// TrustedPublicKeys are given.
+func DisableRangeReads() Opt {
+	return func(opt *options) {
+		opt.noRangeReads = true
+	}
+}
+
+// Retries sets how many times a request which failed with a connection error, a
+// 429 or a 5xx status is retried. A NAR download which fails partway through is
+// resumed with a Range request, up to the same number of times.
+func Retries(retries int) Opt {
+	return func(opt *options) {
+		opt.retries = retries
+	}
+}
+
+// RetryBackoff sets the delay before the first retry, which doubles with every
+// retry up to maxDelay. Delays are jittered. A Retry-After header longer than
+// maxDelay is not waited for.
+func RetryBackoff(baseDelay, maxDelay time.Duration) Opt {
+	return func(opt *options) {
+		if baseDelay < 0 || maxDelay < baseDelay {
+			opt.err = multierr.Append(opt.err, fmt.Errorf("invalid retry backoff: %v to %v", baseDelay, maxDelay))
+			return
+		}
+		opt.retryBaseDelay = baseDelay
+		opt.retryMaxDelay = maxDelay
+	}
+}
+
+// CircuitBreaker skips a cache for cooldown once threshold requests to it in a row
+// have failed, even after retrying. A zero threshold never skips caches.
+func CircuitBreaker(threshold int, cooldown time.Duration) Opt {
+	return func(opt *options) {
+		opt.breakerThreshold = threshold
+		opt.breakerCooldown = cooldown
+	}
+}
+
+// StoreDir sets the store directory the caches must serve. Caches whose
+// nix-cache-info advertises a different one are not used. By default the store
+// directory of the first cache is used.
+func StoreDir(storeDir string) Opt {
+	return func(opt *options) {
+		opt.storeDir = path.Clean(storeDir)
+	}
+}
+
+// StorePaths seeds the listing of the store directory with store paths which are
+// known to exist on the caches. Paths resolved while the filesystem is in use and
+// narinfos in the persistent cache are listed as well.
+func StorePaths(storePaths ...string) Opt {
+	return func(opt *options) {
+		opt.storePaths = append(opt.storePaths, storePaths...)
+	}
+}
+
+// Writable allows store paths to be written to the filesystem. They are kept in a
+// local staging directory until they are committed - explicitly with Commit, or
+// when the last handle to a store path which is a single file is closed - when
+// they are serialized to a NAR and uploaded with its narinfo to the first cache
+// URL, as nix copy does. Uploads fail if that cache serves a different store
+// directory.
+func Writable() Opt {
+	return func(opt *options) {
+		opt.writable = true
+	}
+}
+
+// UploadCompression sets how the NARs of uploaded store paths are compressed, as
+// one of the narinfo Compression values nix supports. The default is xz.
+func UploadCompression(compression string) Opt {
+	return func(opt *options) {
+		if compression != "none" && compressorFor(compression) == nil {
+			opt.err = multierr.Append(opt.err, fmt.Errorf("unsupported upload compression: %s", compression))
+			return
+		}
+		opt.uploadCompression = compression
+	}
+}
+
+// SigningKey specifies a name:base64secret secret key, as generated by
+// nix-store --generate-binary-cache-key, which signs the narinfos of uploaded store
+// paths. Any existing signature by the same key name is replaced.
+func SigningKey(key string) Opt {
+	return func(opt *options) {
+		parsed := nixtypes.NamedPrivateKey{}
+		if err := parsed.UnmarshalText([]byte(key)); err != nil {
+			opt.err = multierr.Append(opt.err, err)
+			return
+		}
+		opt.signingKey = &parsed
+	}
+}
+
+// SignNarInfoFiles also signs the .narinfo files OpenFile returns with the
+// SigningKey, so they can be re-published to another cache.
+func SignNarInfoFiles() Opt {
+	return func(opt *options) {
+		opt.signNarInfoFiles = true
+	}
+}
+
+// S3Credentials sets the AWS access key which signs requests to s3:// caches. By
+// default credentials are taken from the environment or the shared credentials
+// file, as the AWS CLI does, and requests are sent unsigned if there are none.
+func S3Credentials(accessKeyID, secretAccessKey, sessionToken string) Opt {
+	return func(opt *options) {
+		opt.s3Credentials = &s3Credentials{
+			accessKeyID:     accessKeyID,
+			secretAccessKey: secretAccessKey,
+			sessionToken:    sessionToken,
+		}
+	}
+}
+
 // RoundTripper allows replacing the HTTP transport
 func RoundTripper(roundTripper http.RoundTripper) Opt {
 	return func(opt *options) {
@@ -59,3 +254,19 @@ func PersistentCache(path *pathlib.Path) Opt {
 		opt.persistentCache = path
 	}
 }
+
+// PersistentCacheMaxBytes bounds the size of the persistent cache. Once it is
+// exceeded, the least recently used files are evicted.
+func PersistentCacheMaxBytes(maxBytes int64) Opt {
+	return func(opt *options) {
+		opt.persistentCacheMaxBytes = maxBytes
+	}
+}
+
+// PersistentCacheMaxAge evicts files from the persistent cache which have not been
+// used for longer than maxAge.
+func PersistentCacheMaxAge(maxAge time.Duration) Opt {
+	return func(opt *options) {
+		opt.persistentCacheMaxAge = maxAge
+	}
+}
@@ -3,8 +3,11 @@ module github.com/wrouesnel/nix-http-cachefs
 go 1.24.4
 
 require (
+	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
+	github.com/alecthomas/kong v1.9.0
 	github.com/chigopher/pathlib v0.19.1
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/hashicorp/golang-lru/v2 v2.0.7
 	github.com/integralist/go-findroot v0.0.0-20160518114804-ac90681525dc
 	github.com/jdxcode/netrc v1.0.0
 	github.com/magefile/mage v1.15.0
@@ -16,7 +19,9 @@ require (
 	github.com/spf13/afero v1.15.0
 	github.com/wrouesnel/nix-sigman v0.0.0-20251014105522-6b9103301d88
 	go.uber.org/multierr v1.11.0
+	go.uber.org/zap v1.27.0
 	golang.org/x/mod v0.29.0
+	golang.org/x/sync v0.17.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 	gopkg.in/yaml.v3 v3.0.1
 	zombiezen.com/go/nix v0.0.0-20250514174927-d97ab08b45de
@@ -31,7 +36,6 @@ require (
 	github.com/dsnet/compress v0.0.2-0.20230904184137-39efe44ab707 // indirect
 	github.com/golang/snappy v1.0.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
-	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
 	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/klauspost/pgzip v1.2.6 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
@@ -47,6 +51,7 @@ require (
 	github.com/ulikunitz/xz v0.5.15 // indirect
 	github.com/xi2/xz v0.0.0-20171230120015-48954b6210f8 // indirect
 	go4.org v0.0.0-20230225012048-214862532bf5 // indirect
+	golang.org/x/sys v0.35.0 // indirect
 	golang.org/x/text v0.30.0 // indirect
 )
 
@@ -1,34 +1,98 @@
 package nix_http_cachefs
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
 )
 
+// headersSuffix is appended to the name of a cached body to name the sidecar
+// file holding its response headers.
+const headersSuffix = ".headers"
+
+// cachedHeaders are the response headers kept alongside a cached body, so replayed
+// responses behave like the originals.
+var cachedHeaders = []string{ //nolint:gochecknoglobals
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"ETag",
+	"Last-Modified",
+}
+
+// cachedResponse is the sidecar file stored alongside a cached body.
+type cachedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+}
+
 // CachingRoundTripper wraps an http RoundTripper with a simple file-based
 // caching mechanism. It is not a generic HTTP cache - this is specialized
-// for working with nix http binary caches.
+// for working with nix http binary caches, whose files never change once
+// published. Only successful GET responses are cached, keyed by host and path.
 type CachingRoundTripper struct {
 	PersistentCache *pathlib.Path
 	http.RoundTripper
+	// MaxBytes bounds the size of the cache. Least recently used responses are
+	// evicted once it is exceeded. Zero means unbounded.
+	MaxBytes int64
+	// MaxAge evicts responses which have not been used for longer than this. Zero
+	// means responses never expire.
+	MaxAge time.Duration
+
+	pruneMu sync.Mutex
+	// size is the size of the cache as of the last prune, plus anything stored since.
+	size      int64
+	lastPrune time.Time
+}
+
+// cacheDirFor returns the name of the directory responses from u are stored under.
+func (c *CachingRoundTripper) cacheDirFor(u *url.URL) string {
+	key := u.Host
+	// The host of an s3:// URL is only the bucket, and buckets of the same name may
+	// be served from other regions or endpoints.
+	if u.Scheme == s3Scheme {
+		if bucket, err := parseS3Bucket(u); err == nil {
+			key = strings.Join([]string{bucket.name, bucket.region, bucket.host}, "@")
+		}
+	}
+	// Ports are kept so different caches on the same host don't collide, but colons
+	// aren't valid in Windows file names.
+	return strings.ReplaceAll(key, ":", "_")
+}
+
+// cachePathFor returns where the body of a response to request is stored.
+func (c *CachingRoundTripper) cachePathFor(request *http.Request) *pathlib.Path {
+	return c.PersistentCache.Join(c.cacheDirFor(request.URL), path.Clean("/"+request.URL.Path))
 }
 
 func (c *CachingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
-	cacheSuffix := path.Clean(request.URL.Path)
+	// Partial content can't be stored as though it were the whole file. Requests
+	// asking for no-store are for files the caller caches in some other form, and
+	// files of local caches are on disk already.
+	if request.Method != http.MethodGet || request.Header.Get("Range") != "" ||
+		strings.Contains(request.Header.Get("Cache-Control"), "no-store") || request.URL.Scheme == fileScheme {
+		return c.RoundTripper.RoundTrip(request)
+	}
 
-	cachePath := c.PersistentCache.Join(cacheSuffix)
+	cachePath := c.cachePathFor(request)
 
 	// TODO: validate the cache
-	if fh, err := cachePath.Open(); err == nil {
-		// File exists. Return the cache.
-		return &http.Response{
-			Body: fh,
-		}, nil
+	if resp, err := c.replay(request, cachePath); err == nil {
+		c.touch(cachePath)
+		return resp, nil
 	}
 
 	resp, err := c.RoundTripper.RoundTrip(request)
@@ -36,25 +100,151 @@ func (c *CachingRoundTripper) RoundTrip(request *http.Request) (*http.Response,
 		return resp, err
 	}
 
-	if fh, err := cachePath.OpenFile(os.O_CREATE | os.O_WRONLY); err == nil {
-		_, err := io.Copy(fh, resp.Body)
-		fh.Close()
-		resp.Body.Close()
-		if err != nil {
-			return nil, errors.Join(errors.New("cache storage error"), err)
-		} else {
-			// No error. Re-open file and return handle.
-			if fh, err := cachePath.Open(); err == nil {
-				// File exists. Return the cache.
-				return &http.Response{
-					Body: fh,
-				}, nil
-			} else {
-				return nil, errors.Join(errors.New("cache access error after storage"), err)
-			}
+	// Errors and not-found responses are passed through for the caller to handle.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, nil
+	}
+
+	if err := c.store(cachePath, resp); err != nil {
+		return nil, errors.Join(errors.New("cache storage error"), err)
+	}
+
+	// No error. Re-open file and return handle.
+	resp, err = c.replay(request, cachePath)
+	if err != nil {
+		return nil, errors.Join(errors.New("cache access error after storage"), err)
+	}
+	c.stored(resp.ContentLength)
+	return resp, nil
+}
+
+// store writes the response into the cache. Files are written to a temporary file
+// and renamed into place once complete, so an interrupted download or another
+// process sharing the cache never sees a partial file. The sidecar is stored just
+// before the body is renamed into place, so a cached body always has its headers.
+func (c *CachingRoundTripper) store(cachePath *pathlib.Path, resp *http.Response) error {
+	defer resp.Body.Close()
+
+	// NARs are stored under a nar/ subdirectory of the cache.
+	if err := cachePath.Parent().MkdirAll(); err != nil {
+		return err
+	}
+
+	tmpName, err := writeTemp(cachePath, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	sidecarBytes, err := c.headersFor(resp)
+	if err == nil {
+		err = writeAtomic(c.sidecarPath(cachePath), bytes.NewReader(sidecarBytes))
+	}
+	if err == nil {
+		err = cachePath.Fs().Rename(tmpName, cachePath.String())
+	}
+	if err != nil {
+		_ = cachePath.Fs().Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// Evict removes a cached response, such as a download which failed verification.
+func (c *CachingRoundTripper) Evict(u *url.URL) error {
+	cachePath := c.cachePathFor(&http.Request{URL: u})
+	// The body goes first, so a concurrent reader never finds it without its sidecar.
+	if err := removeIfExists(cachePath.Fs(), cachePath.String()); err != nil {
+		return err
+	}
+	return removeIfExists(cachePath.Fs(), c.sidecarPath(cachePath).String())
+}
+
+// writeTemp writes the contents of r to a synced temporary file alongside target,
+// returning its name.
+func writeTemp(target *pathlib.Path, r io.Reader) (string, error) {
+	tmp, err := afero.TempFile(target.Fs(), target.Parent().String(), "."+target.Name()+".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmp.Name()
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err = errors.Join(err, tmp.Close()); err != nil {
+		_ = target.Fs().Remove(tmpName)
+		return "", err
+	}
+	return tmpName, nil
+}
+
+// writeAtomic writes the contents of r to target via a temporary file, which is
+// renamed over target once complete.
+func writeAtomic(target *pathlib.Path, r io.Reader) error {
+	tmpName, err := writeTemp(target, r)
+	if err != nil {
+		return err
+	}
+	if err := target.Fs().Rename(tmpName, target.String()); err != nil {
+		_ = target.Fs().Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+func (c *CachingRoundTripper) sidecarPath(cachePath *pathlib.Path) *pathlib.Path {
+	return pathlib.NewPath(cachePath.String()+headersSuffix, pathlib.PathWithAfero(cachePath.Fs()))
+}
+
+// headersFor renders the sidecar file for a response.
+func (c *CachingRoundTripper) headersFor(resp *http.Response) ([]byte, error) {
+	sidecar := cachedResponse{StatusCode: resp.StatusCode, Header: http.Header{}}
+	for _, key := range cachedHeaders {
+		if values := resp.Header.Values(key); len(values) > 0 {
+			sidecar.Header[key] = values
+		}
+	}
+	return json.Marshal(&sidecar)
+}
+
+// replay builds a response to request from a cached body. Bodies cached without a
+// sidecar are replayed as plain 200 responses. The sidecar is read before the body is
+// opened, since eviction removes the body first.
+func (c *CachingRoundTripper) replay(request *http.Request, cachePath *pathlib.Path) (*http.Response, error) {
+	sidecar := cachedResponse{StatusCode: http.StatusOK, Header: http.Header{}}
+	if sidecarBytes, err := c.sidecarPath(cachePath).ReadFile(); err == nil {
+		if err := json.Unmarshal(sidecarBytes, &sidecar); err != nil {
+			return nil, errors.Join(errors.New("corrupt cache headers"), err)
 		}
 	}
 
-	// Had an error! Return the body as is...
-	return resp, err
+	fh, err := cachePath.Open()
+	if err != nil {
+		return nil, err
+	}
+	finfo, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	if finfo.IsDir() {
+		fh.Close()
+		return nil, fmt.Errorf("%s: is a directory", cachePath.String())
+	}
+
+	// The body on disk is authoritative for the length.
+	sidecar.Header.Set("Content-Length", strconv.FormatInt(finfo.Size(), 10))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", sidecar.StatusCode, http.StatusText(sidecar.StatusCode)),
+		StatusCode:    sidecar.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        sidecar.Header,
+		Body:          fh,
+		ContentLength: finfo.Size(),
+		Request:       request,
+	}, nil
 }
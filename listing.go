@@ -0,0 +1,373 @@
+package nix_http_cachefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/mholt/archives"
+	"zombiezen.com/go/nix/nar"
+)
+
+// defaultListingCacheSize is the number of NAR listings retained after their NARs are closed.
+const defaultListingCacheSize = 1024
+
+// peekReuseTimeout is how long the response of a peeked NAR is kept for a download
+// of the NAR which may follow.
+const peekReuseTimeout = 10 * time.Second
+
+// listingCache retains NAR listings, and the root headers of NARs we have only
+// peeked at, so metadata queries can be answered without downloading anything.
+type listingCache struct {
+	listings *lru.Cache[string, *nar.Listing]
+	roots    *lru.Cache[string, nar.Header]
+	// unlisted tracks store paths whose cache serves no .ls listing.
+	unlisted *lru.Cache[string, struct{}]
+}
+
+func newListingCache(size int) *listingCache {
+	if size <= 0 {
+		size = 1
+	}
+	// lru.New only errors on a non-positive size.
+	listings, _ := lru.New[string, *nar.Listing](size)
+	roots, _ := lru.New[string, nar.Header](size)
+	unlisted, _ := lru.New[string, struct{}](size)
+	return &listingCache{listings: listings, roots: roots, unlisted: unlisted}
+}
+
+func (lc *listingCache) addListing(storePath string, listing *nar.Listing) {
+	lc.listings.Add(storePath, listing)
+}
+
+func (lc *listingCache) getListing(storePath string) (*nar.Listing, bool) {
+	return lc.listings.Get(storePath)
+}
+
+// getRoot returns the header of the root object of the store path, if known.
+func (lc *listingCache) getRoot(storePath string) (nar.Header, bool) {
+	if listing, ok := lc.listings.Get(storePath); ok {
+		return listing.Root.Header, true
+	}
+	return lc.roots.Get(storePath)
+}
+
+func (lc *listingCache) addRoot(storePath string, hdr nar.Header) {
+	lc.roots.Add(storePath, hdr)
+}
+
+// getListing returns the listing for the narinfo's store path, fetching the binary
+// cache's .ls listing if we don't already have one. Listings from .ls files can't be
+// verified against the NarHash, so they aren't fetched when signatures are required
+// and the listing must come from a verified NAR instead.
+func (fs *nixHttpCacheFs) getListing(ctx context.Context, ninfo *ninfoWithOrigin) (*nar.Listing, bool) {
+	storePath := ninfo.ninfo.StorePath
+	if listing, ok := fs.listings.getListing(storePath); ok {
+		return listing, true
+	}
+	if fs.listings.unlisted.Contains(storePath) {
+		return nil, false
+	}
+	if fs.narStore != nil {
+		if listing, err := fs.narStore.listing(ninfo.ninfo); err == nil {
+			fs.listings.addListing(storePath, listing)
+			return listing, true
+		}
+	}
+	if fs.opts.requireSigs {
+		return nil, false
+	}
+
+	// Concurrent lookups of the same listing share a single fetch.
+	fetched, err := shareFlight(ctx, &fs.listingFlight, storePath, func(ctx context.Context) (interface{}, error) {
+		return fs.fetchListing(ctx, ninfo)
+	})
+	if err != nil {
+		fs.debugLog("getListing", "no listing available", storePath, err.Error())
+		// Only remember the cache has no listing if it said so, rather than
+		// because the request was cancelled or failed.
+		if errors.Is(err, ErrNotFound) {
+			fs.listings.unlisted.Add(storePath, struct{}{})
+		}
+		return nil, false
+	}
+
+	listing := fetched.(*nar.Listing)
+	fs.listings.addListing(storePath, listing)
+	return listing, true
+}
+
+// fetchListing retrieves and parses the .ls listing for a store path from the cache
+// which served its narinfo. cache.nixos.org serves these brotli-compressed, either
+// with a Content-Encoding header or as raw compressed bytes.
+func (fs *nixHttpCacheFs) fetchListing(ctx context.Context, ninfo *ninfoWithOrigin) (*nar.Listing, error) {
+	hashPart, _, _ := strings.Cut(path.Base(ninfo.ninfo.StorePath), "-")
+	listingUrl := ninfo.cacheUrl.JoinPath(hashPart + nar.ListingExtension).String()
+	fs.debugLog("HTTP Request", http.MethodGet, listingUrl)
+
+	resp, err := fs.get(ctx, ninfo.cacheUrl, listingUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if kind := statusKind(resp.StatusCode); kind != nil {
+		return nil, &CacheError{URL: listingUrl, Kind: kind, Err: errors.New(resp.Status)}
+	}
+
+	listingBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Header.Get("Content-Encoding") == "br" || !bytes.HasPrefix(bytes.TrimSpace(listingBytes), []byte("{")) {
+		decompressed, err := new(archives.Brotli).OpenReader(bytes.NewReader(listingBytes))
+		if err != nil {
+			return nil, err
+		}
+		defer decompressed.Close()
+		listingBytes, err = io.ReadAll(decompressed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listing := new(nar.Listing)
+	if err := listing.UnmarshalJSON(listingBytes); err != nil {
+		return nil, err
+	}
+	return listing, nil
+}
+
+// namedFileInfo overrides the name of a wrapped FileInfo. NAR root headers have
+// an empty name, which is unhelpful when the root is a store path.
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (n *namedFileInfo) Name() string {
+	return n.name
+}
+
+func (n *namedFileInfo) Size() int64 {
+	return n.size
+}
+
+// namedDir overrides the Stat of a directory handle, so store path roots opened
+// as directories report the same FileInfo as Stat does.
+type namedDir struct {
+	fs.ReadDirFile
+	finfo fs.FileInfo
+}
+
+func (d *namedDir) Stat() (fs.FileInfo, error) {
+	return d.finfo, nil
+}
+
+// rootFileInfo produces the FileInfo for the root of a store path. Directories
+// report the NarSize from the narinfo since they have no size of their own.
+func rootFileInfo(storePath string, narSize uint64, hdr nar.Header) os.FileInfo {
+	size := hdr.Size
+	if hdr.Mode.IsDir() {
+		size = int64(narSize)
+	}
+	return &namedFileInfo{FileInfo: hdr.FileInfo(), name: path.Base(storePath), size: size}
+}
+
+// splitStoreName splits a requested name into the store path it lies within and the
+// name within that store path's NAR ("." for the root).
+func (fs *nixHttpCacheFs) splitStoreName(ctx context.Context, name string) (string, string, bool) {
+	storeDir := fs.getStoreDir(ctx)
+	narPathWithoutPrefix, found := strings.CutPrefix(name, storeDir)
+	if !found || storeDir == "" {
+		return "", "", false
+	}
+	storeObject, nameWithinArchive, _ := strings.Cut(strings.TrimPrefix(narPathWithoutPrefix, "/"), "/")
+	if storeObject == "" {
+		return "", "", false
+	}
+	nameWithinArchive = path.Clean("/" + nameWithinArchive)[1:]
+	if nameWithinArchive == "" {
+		nameWithinArchive = "."
+	}
+	return path.Join(storeDir, storeObject), nameWithinArchive, true
+}
+
+// isNarInfoName reports whether name is a store path's .narinfo, which a binary
+// cache serves alongside it.
+func (fs *nixHttpCacheFs) isNarInfoName(ctx context.Context, name string) bool {
+	storePath, within, ok := fs.splitStoreName(ctx, name)
+	return ok && within == "." && strings.HasSuffix(storePath, ".narinfo")
+}
+
+// rootHeader returns the header of the root object of the narinfo's NAR. If no
+// listing is available only the start of the NAR is read, unless signatures are
+// required, in which case the whole NAR is fetched and verified.
+func (fs *nixHttpCacheFs) rootHeader(ctx context.Context, ninfo *ninfoWithOrigin) (nar.Header, error) {
+	storePath := ninfo.ninfo.StorePath
+	if hdr, ok := fs.listings.getRoot(storePath); ok {
+		return hdr, nil
+	}
+	if listing, ok := fs.getListing(ctx, ninfo); ok {
+		return listing.Root.Header, nil
+	}
+	if fs.opts.requireSigs {
+		shared, err := fs.openNar(ctx, ninfo)
+		if err != nil {
+			return nar.Header{}, err
+		}
+		defer shared.release()
+		return shared.listing.Root.Header, nil
+	}
+	peeked, err := fs.peekNarRoot(ctx, ninfo)
+	if err != nil {
+		return nar.Header{}, err
+	}
+	fs.listings.addRoot(storePath, *peeked)
+	return *peeked, nil
+}
+
+// peekNarRoot reads just enough of the NAR to learn the type of its root object. The
+// NAR can't be verified from a partial read, so this is only used for metadata. The
+// rest of the response is kept for a while, so a download of the NAR which follows
+// can carry on from it rather than requesting it again.
+func (fs *nixHttpCacheFs) peekNarRoot(ctx context.Context, ninfo *ninfoWithOrigin) (*nar.Header, error) {
+	fs.debugLog("peekNarRoot", ninfo.ninfo.StorePath, ninfo.cacheUrl.String())
+
+	narUrl, err := url.Parse(ninfo.ninfo.URL)
+	if err != nil {
+		return nil, err
+	}
+	resolvedUrl, err := resolveCacheUrl(ninfo.cacheUrl, narUrl)
+	if err != nil {
+		return nil, &CacheError{URL: narUrl.Redacted(), Kind: ErrCorrupt, Err: err}
+	}
+	fs.debugLog("HTTP Request", http.MethodGet, resolvedUrl.String())
+
+	// The response outlives ctx if it is kept, so the request is only cancelled
+	// with ctx until the root header has been read.
+	reqCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+
+	// Only part of the NAR is read, which mustn't be persistently cached as
+	// though it were the whole of it.
+	resp, err := fs.get(reqCtx, ninfo.cacheUrl, resolvedUrl.String(), http.Header{"Cache-Control": {"no-store"}})
+	if err != nil {
+		stop()
+		cancel()
+		return nil, &CacheError{URL: resolvedUrl.String(), Kind: ErrTransient, Err: err}
+	}
+	discard := func() {
+		stop()
+		resp.Body.Close()
+		cancel()
+	}
+
+	// Error pages mustn't be parsed as NARs.
+	if kind := statusKind(resp.StatusCode); kind != nil {
+		discard()
+		return nil, &CacheError{URL: resolvedUrl.String(), Kind: kind, Err: errors.New(resp.Status)}
+	}
+
+	// What is read of the body is kept to replay to a download which follows.
+	prefix := new(bytes.Buffer)
+	var narReader io.Reader = io.TeeReader(resp.Body, prefix)
+	var decompressed io.ReadCloser
+	if compressor := decompressorFor(ninfo.ninfo.Compression); compressor != nil {
+		decompressed, err = compressor.OpenReader(narReader)
+		if err != nil {
+			discard()
+			return nil, &CacheError{URL: resolvedUrl.String(), Kind: readKind(err), Err: err}
+		}
+		narReader = decompressed
+	}
+
+	hdr, err := nar.NewReader(narReader).Next()
+	// Decompressors may read ahead, so are done with before the prefix is kept.
+	if decompressed != nil {
+		decompressed.Close()
+	}
+	if stop() && err == nil {
+		fs.peeks.keep(resolvedUrl.String(), &peekedNar{resp: resp, prefix: prefix.Bytes(), cancel: cancel})
+	} else {
+		discard()
+	}
+	if err != nil {
+		return nil, &CacheError{URL: resolvedUrl.String(), Kind: readKind(err), Err: err}
+	}
+	return hdr, nil
+}
+
+// peekedNar is a response which a NAR was peeked at from, and the part of the
+// body which was read.
+type peekedNar struct {
+	resp   *http.Response
+	prefix []byte
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+func (p *peekedNar) Close() error {
+	defer p.cancel()
+	return p.resp.Body.Close()
+}
+
+// peekedNars keeps the responses of peeked NARs by URL, until a download claims
+// them or they time out.
+type peekedNars struct {
+	mu    sync.Mutex
+	peeks map[string]*peekedNar
+}
+
+func newPeekedNars() *peekedNars {
+	return &peekedNars{peeks: map[string]*peekedNar{}}
+}
+
+// keep holds on to peek until it is claimed, for up to peekReuseTimeout.
+func (p *peekedNars) keep(narUrl string, peek *peekedNar) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if previous, found := p.peeks[narUrl]; found && previous.timer.Stop() {
+		previous.Close()
+	}
+	p.peeks[narUrl] = peek
+	peek.timer = time.AfterFunc(peekReuseTimeout, func() {
+		p.mu.Lock()
+		if p.peeks[narUrl] == peek {
+			delete(p.peeks, narUrl)
+		}
+		p.mu.Unlock()
+		peek.Close()
+	})
+}
+
+// claim returns the response of a peek at the NAR at narUrl with its body
+// rewound to the start, or nil if there isn't one.
+func (p *peekedNars) claim(narUrl string) *http.Response {
+	p.mu.Lock()
+	peek, found := p.peeks[narUrl]
+	delete(p.peeks, narUrl)
+	p.mu.Unlock()
+	if !found || !peek.timer.Stop() {
+		return nil
+	}
+
+	resp := *peek.resp
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peek.prefix), peek.resp.Body), peek}
+	return &resp
+}
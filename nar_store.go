@@ -0,0 +1,197 @@
+package nix_http_cachefs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/chigopher/pathlib"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"zombiezen.com/go/nix/nar"
+)
+
+// narStoreDir is the directory of the persistent cache holding the NAR store.
+// Responses are cached under their host name, which can't start with an underscore.
+const narStoreDir = "_nars"
+
+// narStore is a content-addressed store of decompressed NARs in the persistent
+// cache, keyed by their NarHash. Each NAR is kept with its listing, so it can be
+// opened again without decompressing or parsing it, whichever cache served it.
+// Files in the store are bounded and evicted along with the rest of the cache.
+type narStore struct {
+	cache *CachingRoundTripper
+	// verify is set when signatures are required. Files on disk aren't signed, so
+	// a NAR stored before the filesystem was created is checked against its
+	// NarHash the first time it is opened, and its listing is rebuilt from it.
+	verify bool
+
+	mu sync.Mutex
+	// verified are the NARs stored or checked since the filesystem was created.
+	verified map[string]struct{}
+}
+
+// pathFor returns where the NAR with narHash is stored, or nil if the narinfo
+// gave no usable NarHash.
+func (s *narStore) pathFor(narHash nixtypes.TypedNixHash) *pathlib.Path {
+	if narHash.HashName == "" || len(narHash.Hash) == 0 {
+		return nil
+	}
+	return s.cache.PersistentCache.Join(narStoreDir, narHash.HashName, narHash.Hash.String()+".nar")
+}
+
+func listingPathFor(narPath *pathlib.Path) *pathlib.Path {
+	return pathlib.NewPath(narPath.String()+nar.ListingExtension, pathlib.PathWithAfero(narPath.Fs()))
+}
+
+// open returns the stored NAR for the narinfo and its listing. NARs are verified
+// before they are stored, so unless verify is set only their size is checked here.
+// A missing or corrupt listing is rebuilt from the NAR.
+func (s *narStore) open(ninfo *nixtypes.NarInfo) (*cachedFile, *nar.Listing, error) {
+	narPath := s.pathFor(ninfo.NarHash)
+	if narPath == nil {
+		return nil, nil, errors.New("narinfo has no NarHash")
+	}
+	fh, err := narPath.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	finfo, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, nil, err
+	}
+	if uint64(finfo.Size()) != ninfo.NarSize {
+		fh.Close()
+		_ = removeIfExists(narPath.Fs(), narPath.String())
+		return nil, nil, fmt.Errorf("%s: stored NAR is %d bytes rather than %d", narPath.String(), finfo.Size(), ninfo.NarSize)
+	}
+	s.cache.touch(narPath)
+
+	if s.verify && !s.isVerified(narPath) {
+		listing, err := s.check(narPath, fh, ninfo)
+		if err != nil {
+			fh.Close()
+			_ = removeIfExists(narPath.Fs(), narPath.String())
+			return nil, nil, fmt.Errorf("%s: %w", narPath.String(), err)
+		}
+		// The listing is only an optimization, so failing to store it isn't an error.
+		_ = s.writeListing(narPath, listing)
+		return &cachedFile{cached: fh}, listing, nil
+	}
+
+	listing, err := s.readListing(narPath)
+	if err != nil {
+		listing, err = nar.List(fh)
+		if err != nil {
+			fh.Close()
+			_ = removeIfExists(narPath.Fs(), narPath.String())
+			return nil, nil, fmt.Errorf("%s: %w", narPath.String(), err)
+		}
+		// The listing is only an optimization, so failing to store it isn't an error.
+		_ = s.writeListing(narPath, listing)
+	}
+	return &cachedFile{cached: fh}, listing, nil
+}
+
+// listing returns the stored listing of the NAR for the narinfo, which is there
+// whenever the NAR has been downloaded before. If verify is set, it is only
+// returned once the NAR has been checked.
+func (s *narStore) listing(ninfo *nixtypes.NarInfo) (*nar.Listing, error) {
+	narPath := s.pathFor(ninfo.NarHash)
+	if narPath == nil {
+		return nil, errors.New("narinfo has no NarHash")
+	}
+	if s.verify && !s.isVerified(narPath) {
+		return nil, errors.New("stored NAR has not been verified")
+	}
+	return s.readListing(narPath)
+}
+
+// check verifies a stored NAR against the narinfo, and lists it as it goes.
+func (s *narStore) check(narPath *pathlib.Path, narFile io.Reader, ninfo *nixtypes.NarInfo) (*nar.Listing, error) {
+	verifier, err := newVerifyingReader(narFile, "stored nar", ninfo.NarHash, ninfo.NarSize)
+	if err != nil {
+		return nil, err
+	}
+	listing, err := nar.List(verifier)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, verifier); err != nil {
+		return nil, err
+	}
+	if err := verifier.Verify(); err != nil {
+		return nil, err
+	}
+	s.markVerified(narPath)
+	return listing, nil
+}
+
+func (s *narStore) isVerified(narPath *pathlib.Path) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.verified[narPath.String()]
+	return found
+}
+
+func (s *narStore) markVerified(narPath *pathlib.Path) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.verified == nil {
+		s.verified = map[string]struct{}{}
+	}
+	s.verified[narPath.String()] = struct{}{}
+}
+
+func (s *narStore) readListing(narPath *pathlib.Path) (*nar.Listing, error) {
+	listingPath := listingPathFor(narPath)
+	listingBytes, err := listingPath.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	listing := new(nar.Listing)
+	if err := listing.UnmarshalJSON(listingBytes); err != nil {
+		_ = removeIfExists(listingPath.Fs(), listingPath.String())
+		return nil, fmt.Errorf("%s: %w", listingPath.String(), err)
+	}
+	s.cache.touch(listingPath)
+	return listing, nil
+}
+
+func (s *narStore) writeListing(narPath *pathlib.Path, listing *nar.Listing) error {
+	listingBytes, err := listing.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := writeAtomic(listingPathFor(narPath), bytes.NewReader(listingBytes)); err != nil {
+		return err
+	}
+	s.cache.stored(int64(len(listingBytes)))
+	return nil
+}
+
+// add stores a verified NAR and its listing. The listing goes first, so a stored
+// NAR is only without one if the listing was since evicted.
+func (s *narStore) add(ninfo *nixtypes.NarInfo, narFile io.ReadSeeker, listing *nar.Listing) error {
+	narPath := s.pathFor(ninfo.NarHash)
+	if narPath == nil {
+		return nil
+	}
+	if err := narPath.Parent().MkdirAll(); err != nil {
+		return err
+	}
+	if err := s.writeListing(narPath, listing); err != nil {
+		return err
+	}
+	if _, err := narFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := writeAtomic(narPath, narFile); err != nil {
+		return err
+	}
+	s.markVerified(narPath)
+	s.cache.stored(int64(ninfo.NarSize))
+	return nil
+}
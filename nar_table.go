@@ -0,0 +1,150 @@
+package nix_http_cachefs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/nix/nar"
+)
+
+// defaultNarIdleTimeout is how long an unreferenced NAR is kept open so that
+// sequential access (i.e. walking a tree) doesn't redownload it for every file.
+const defaultNarIdleTimeout = 30 * time.Second
+
+// sharedNar is a decompressed NAR and its listing shared between every handle
+// opened into the same store path.
+type sharedNar struct {
+	table     *narTable
+	storePath string
+	file      *cachedFile
+	listing   *nar.Listing
+	// ready is closed once file, listing and err have been set by the fetching caller.
+	ready chan struct{}
+	err   error
+
+	// refs and idleGen are protected by the table mutex. idleGen is bumped every
+	// time refs transitions so stale eviction timers can tell they lost a race.
+	refs    int64
+	idleGen uint64
+}
+
+// release drops a reference to the NAR. When the last reference is dropped the
+// NAR is evicted once it has been idle for the table's idle timeout.
+func (n *sharedNar) release() {
+	n.table.release(n)
+}
+
+// narTable is an in-memory, reference counted table of opened NARs keyed by store path.
+// Entries are added before their NAR has been fetched so that concurrent openers of the
+// same store path wait on a single download.
+type narTable struct {
+	mu          sync.Mutex
+	nars        map[string]*sharedNar
+	idleTimeout time.Duration
+}
+
+func newNarTable(idleTimeout time.Duration) *narTable {
+	return &narTable{
+		nars:        make(map[string]*sharedNar),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// open returns the NAR for storePath with its reference count incremented. If it is not
+// already open or being fetched, fetch is called to retrieve it; concurrent callers for
+// the same store path wait for that fetch rather than starting their own. Waiters give
+// up when their own context is done, and retry if the fetch was cancelled by the
+// context of the caller which started it.
+func (t *narTable) open(ctx context.Context, storePath string,
+	fetch func(ctx context.Context) (*cachedFile, *nar.Listing, error),
+) (*sharedNar, error) {
+	t.mu.Lock()
+	if n, found := t.nars[storePath]; found {
+		n.refs++
+		n.idleGen++
+		t.mu.Unlock()
+		select {
+		case <-n.ready:
+		case <-ctx.Done():
+			// The fetch carries on for anyone else waiting on it.
+			go func() {
+				<-n.ready
+				t.release(n)
+			}()
+			return nil, ctx.Err()
+		}
+		if n.err != nil {
+			t.release(n)
+			if ctx.Err() == nil && isContextErr(n.err) {
+				return t.open(ctx, storePath, fetch)
+			}
+			return nil, n.err
+		}
+		return n, nil
+	}
+	n := &sharedNar{
+		table:     t,
+		storePath: storePath,
+		ready:     make(chan struct{}),
+		refs:      1,
+	}
+	t.nars[storePath] = n
+	t.mu.Unlock()
+
+	n.file, n.listing, n.err = fetch(ctx)
+	if n.err != nil {
+		// Failed fetches must not be handed to later callers.
+		t.mu.Lock()
+		if t.nars[storePath] == n {
+			delete(t.nars, storePath)
+		}
+		t.mu.Unlock()
+	}
+	close(n.ready)
+
+	if n.err != nil {
+		t.release(n)
+		return nil, n.err
+	}
+	return n, nil
+}
+
+// isOpen reports whether the NAR for storePath is open or being fetched.
+func (t *narTable) isOpen(storePath string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, found := t.nars[storePath]
+	return found
+}
+
+func (t *narTable) release(n *sharedNar) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n.refs--
+	n.idleGen++
+	if n.refs > 0 {
+		return
+	}
+	if t.idleTimeout <= 0 || n.err != nil {
+		t.evictLocked(n)
+		return
+	}
+	gen := n.idleGen
+	time.AfterFunc(t.idleTimeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if n.refs == 0 && n.idleGen == gen {
+			t.evictLocked(n)
+		}
+	})
+}
+
+func (t *narTable) evictLocked(n *sharedNar) {
+	if t.nars[n.storePath] == n {
+		delete(t.nars, n.storePath)
+	}
+	if n.file != nil {
+		_ = n.file.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package nix_http_cachefs
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chigopher/pathlib"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// defaultNegativeCacheTTL is how long a narinfo a cache reported missing is assumed
+// to stay missing. It matches nix's narinfo-cache-negative-ttl.
+const defaultNegativeCacheTTL = time.Hour
+
+// negativeCacheSize is the number of missing narinfos remembered in memory.
+const negativeCacheSize = 65536
+
+// missingSuffix is appended to the name a response would be cached under to name
+// the marker recording that it was missing.
+const missingSuffix = ".missing"
+
+// negativeCache records narinfo URLs which a cache answered with a 404, so repeated
+// probes for store paths it doesn't have don't go back to the network. Entries are
+// kept per cache URL, in memory and - if there is one - in the persistent cache,
+// where the marker's modification time records when the miss was seen.
+type negativeCache struct {
+	ttl        time.Duration
+	misses     *lru.Cache[string, time.Time]
+	persistent *CachingRoundTripper
+}
+
+func newNegativeCache(ttl time.Duration, persistent *CachingRoundTripper) *negativeCache {
+	// lru.New only errors on a non-positive size.
+	misses, _ := lru.New[string, time.Time](negativeCacheSize)
+	return &negativeCache{ttl: ttl, misses: misses, persistent: persistent}
+}
+
+// markerPath is where the persistent record of a miss for u is kept.
+func (nc *negativeCache) markerPath(u *url.URL) *pathlib.Path {
+	cachePath := nc.persistent.cachePathFor(&http.Request{URL: u})
+	return pathlib.NewPath(cachePath.String()+missingSuffix, pathlib.PathWithAfero(cachePath.Fs()))
+}
+
+// isMissing reports whether u was recently found to be missing.
+func (nc *negativeCache) isMissing(u *url.URL) bool {
+	if nc.ttl <= 0 {
+		return false
+	}
+	key := u.String()
+	if seen, found := nc.misses.Get(key); found {
+		if time.Since(seen) < nc.ttl {
+			return true
+		}
+		nc.misses.Remove(key)
+	}
+
+	if nc.persistent == nil {
+		return false
+	}
+	marker := nc.markerPath(u)
+	finfo, err := marker.Stat()
+	if err != nil {
+		return false
+	}
+	if time.Since(finfo.ModTime()) >= nc.ttl {
+		_ = removeIfExists(marker.Fs(), marker.String())
+		return false
+	}
+	nc.misses.Add(key, finfo.ModTime())
+	return true
+}
+
+// addMissing records that u is missing.
+func (nc *negativeCache) addMissing(u *url.URL) error {
+	if nc.ttl <= 0 {
+		return nil
+	}
+	nc.misses.Add(u.String(), time.Now())
+
+	if nc.persistent == nil {
+		return nil
+	}
+	marker := nc.markerPath(u)
+	if err := marker.Parent().MkdirAll(); err != nil {
+		return err
+	}
+	// The marker is empty, so writing it in place can't leave a partial file. Writing
+	// it again refreshes its modification time.
+	return marker.WriteFile(nil)
+}
+
+// removeMissing forgets that u was missing, such as once it has been uploaded.
+func (nc *negativeCache) removeMissing(u *url.URL) error {
+	nc.misses.Remove(u.String())
+	if nc.persistent == nil {
+		return nil
+	}
+	marker := nc.markerPath(u)
+	return removeIfExists(marker.Fs(), marker.String())
+}
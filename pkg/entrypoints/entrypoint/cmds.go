@@ -0,0 +1,42 @@
+package entrypoint
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/alecthomas/kong"
+	"go.uber.org/zap"
+)
+
+// ErrCommand is returned when a command fails.
+type ErrCommand struct{}
+
+func (e *ErrCommand) Error() string {
+	return "command failed"
+}
+
+type CmdContext struct {
+	logger *zap.Logger
+	ctx    context.Context
+	stdIn  io.ReadCloser
+	stdOut io.Writer
+}
+
+// Main command dispatcher for the program entrypoint. New commands should be added here, or they won't be
+// invocable.
+func dispatchCommands(ctx *kong.Context, cmdCtx *CmdContext) error {
+	var err error
+	logger := cmdCtx.logger.With(zap.String("command", ctx.Command()))
+	cmdCtx.logger = logger
+
+	switch ctx.Command() {
+	case "mount <mountpoint> <cache-urls>":
+		err = Mount(cmdCtx)
+
+	default:
+		err = errors.Join(&ErrCommand{}, errors.New("unknown command: "+ctx.Command()))
+	}
+
+	return err
+}
@@ -0,0 +1,93 @@
+package entrypoint
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/alecthomas/kong"
+	"github.com/wrouesnel/nix-http-cachefs/version"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+//nolint:gochecknoglobals
+var CLI struct {
+	Version kong.VersionFlag `help:"Show version number"`
+
+	Logging struct {
+		Level  string `help:"logging level" default:"info"`
+		Format string `help:"logging format (${enum})" enum:"console,json" default:"console"`
+	} `embed:"" prefix:"log-"`
+
+	Mount MountConfig `cmd:"" help:"Mount binary caches as a FUSE filesystem"`
+}
+
+// Entrypoint is the real application entrypoint. This structure allows test packages to E2E-style tests invoking commands
+// as though they are on the command line, but using built-in coverage tools. Stub-main under the `cmd` package calls this
+// function.
+func Entrypoint(stdIn io.ReadCloser, stdOut io.Writer, stdErr io.Writer) int {
+	appCtx, appCancel := context.WithCancel(context.Background())
+	defer appCancel()
+
+	vars := kong.Vars{"version": version.Version}
+	ctx := kong.Parse(&CLI,
+		kong.DefaultEnvars(version.Name),
+		kong.Description(version.Description),
+		kong.Writers(stdOut, stdErr),
+		vars)
+
+	// Initialize logging as soon as possible
+	deferredLogs := []string{}
+	logConfig := zap.NewProductionConfig()
+	if err := logConfig.Level.UnmarshalText([]byte(CLI.Logging.Level)); err != nil {
+		deferredLogs = append(deferredLogs, err.Error())
+	}
+	logConfig.Encoding = CLI.Logging.Format
+	logConfig.EncoderConfig.EncodeTime = zapcore.RFC3339TimeEncoder
+	if CLI.Logging.Format == "console" {
+		logConfig.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	}
+
+	logger, err := logConfig.Build()
+	if err != nil {
+		// Error unhandled since this is a very early failure
+		_, _ = io.WriteString(stdErr, "Failure while building logger")
+		return 1
+	}
+
+	logger.Debug("Configuring signal handling")
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sigCtx, cancelFn := context.WithCancel(appCtx)
+	go func() {
+		sig := <-sigCh
+		logger.Info("Caught signal - exiting", zap.String("signal", sig.String()))
+		cancelFn()
+	}()
+
+	// Install as the global logger
+	zap.ReplaceGlobals(logger)
+
+	// Emit deferred logs
+	for _, line := range deferredLogs {
+		logger.Error(line)
+	}
+
+	cmdCtx := &CmdContext{
+		logger: logger,
+		ctx:    sigCtx,
+		stdIn:  stdIn,
+		stdOut: stdOut,
+	}
+
+	if err := dispatchCommands(ctx, cmdCtx); err != nil {
+		logger.Error("Error from command", zap.Error(err))
+		return 1
+	}
+
+	logger.Debug("Exiting normally")
+	return 0
+}
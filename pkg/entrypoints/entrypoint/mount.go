@@ -0,0 +1,120 @@
+package entrypoint
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chigopher/pathlib"
+	"github.com/spf13/afero"
+	nix_http_cachefs "github.com/wrouesnel/nix-http-cachefs"
+	"go.uber.org/zap"
+)
+
+type MountConfig struct {
+	StoreDir                string        `help:"Store directory served by the binary caches" default:"/nix/store"`
+	NetrcFile               string        `help:"netrc file with credentials for the binary caches" type:"existingfile"`
+	PersistentCache         string        `help:"Directory to persistently cache downloaded files in" type:"existingdir"`
+	PersistentCacheMaxBytes int64         `help:"Evict least recently used files once the persistent cache exceeds this many bytes (0 is unbounded)"`
+	PersistentCacheMaxAge   time.Duration `help:"Evict files from the persistent cache unused for this long (0 never expires)"`
+	NegativeCacheTTL        time.Duration `help:"How long a store path missing from a binary cache is assumed to stay missing" default:"1h"`
+	Retries                 int           `help:"How many times to retry requests which failed transiently" default:"3"`
+	CircuitBreakerThreshold int           `help:"Skip a binary cache after this many failed requests in a row (0 never skips)" default:"5"`
+	CircuitBreakerCooldown  time.Duration `help:"How long to skip a failing binary cache for" default:"30s"`
+	TrustedPublicKeys       []string      `help:"Public keys narinfos must be signed by"`
+	SecretKeyFile           string        `help:"Secret key file to sign the .narinfo files served with" type:"existingfile"`
+	StorePaths              []string      `help:"Store paths to list in the store directory before they have been accessed"`
+	DisableRangeReads       bool          `help:"Always download whole NARs rather than reading files in uncompressed NARs with unverified Range requests"`
+	AllowOther              bool          `help:"Allow other users to access the mount"`
+	Mountpoint              string        `arg:"" help:"Directory to mount the store directory at" type:"existingdir"`
+	CacheUrls               []string      `arg:"" help:"Binary cache URLs"`
+}
+
+// Mount serves the binary caches as a FUSE filesystem until interrupted.
+func Mount(cmdCtx *CmdContext) error {
+	l := cmdCtx.logger
+	config := &CLI.Mount
+
+	cacheFs, err := newCacheFs(l, config)
+	if err != nil {
+		l.Error("Error configuring the binary cache filesystem", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+
+	// Fail early if the caches don't serve the store directory we were asked to mount.
+	finfo, err := cacheFs.Stat(config.StoreDir)
+	if err != nil {
+		l.Error("Store directory is not served by the binary caches", zap.String("store-dir", config.StoreDir), zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+	if !finfo.IsDir() {
+		return errors.Join(&ErrCommand{}, fmt.Errorf("%s is not a directory", config.StoreDir))
+	}
+
+	l.Info("Mounting binary caches",
+		zap.String("mountpoint", config.Mountpoint),
+		zap.String("store-dir", config.StoreDir),
+		zap.Strings("cache-urls", config.CacheUrls))
+	if err := mountFs(cmdCtx.ctx, cacheFs, config); err != nil {
+		l.Error("Error serving the mount", zap.Error(err))
+		return errors.Join(&ErrCommand{}, err)
+	}
+	l.Info("Unmounted", zap.String("mountpoint", config.Mountpoint))
+	return nil
+}
+
+// newCacheFs builds the NixHttpCacheFs described by the mount configuration.
+func newCacheFs(l *zap.Logger, config *MountConfig) (afero.Fs, error) {
+	cacheUrls := make([]*url.URL, 0, len(config.CacheUrls))
+	for _, cacheUrl := range config.CacheUrls {
+		parsedUrl, err := url.Parse(cacheUrl)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("invalid cache URL: %s", cacheUrl), err)
+		}
+		cacheUrls = append(cacheUrls, parsedUrl)
+	}
+
+	opts := []nix_http_cachefs.Opt{
+		nix_http_cachefs.ErrorLogger(func(msg string) {
+			l.Error(msg, zap.String("fs-backend", "nix-http-cache"))
+		}),
+		nix_http_cachefs.DebugLogger(func(msg string) {
+			l.Debug(msg, zap.String("fs-backend", "nix-http-cache"))
+		}),
+		nix_http_cachefs.NegativeCacheTTL(config.NegativeCacheTTL),
+		nix_http_cachefs.StoreDir(config.StoreDir),
+		nix_http_cachefs.Retries(config.Retries),
+		nix_http_cachefs.CircuitBreaker(config.CircuitBreakerThreshold, config.CircuitBreakerCooldown),
+	}
+	if config.NetrcFile != "" {
+		opts = append(opts, nix_http_cachefs.NetrcFile(config.NetrcFile))
+	}
+	if config.PersistentCache != "" {
+		opts = append(opts, nix_http_cachefs.PersistentCache(
+			pathlib.NewPath(config.PersistentCache, pathlib.PathWithAfero(afero.NewOsFs()))),
+			nix_http_cachefs.PersistentCacheMaxBytes(config.PersistentCacheMaxBytes),
+			nix_http_cachefs.PersistentCacheMaxAge(config.PersistentCacheMaxAge))
+	}
+	if len(config.TrustedPublicKeys) > 0 {
+		opts = append(opts, nix_http_cachefs.TrustedPublicKeys(config.TrustedPublicKeys...))
+	}
+	if config.SecretKeyFile != "" {
+		secretKey, err := os.ReadFile(config.SecretKeyFile)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("reading secret key file: %s", config.SecretKeyFile), err)
+		}
+		opts = append(opts, nix_http_cachefs.SigningKey(strings.TrimSpace(string(secretKey))),
+			nix_http_cachefs.SignNarInfoFiles())
+	}
+	if len(config.StorePaths) > 0 {
+		opts = append(opts, nix_http_cachefs.StorePaths(config.StorePaths...))
+	}
+	if config.DisableRangeReads {
+		opts = append(opts, nix_http_cachefs.DisableRangeReads())
+	}
+
+	return nix_http_cachefs.NewNixHttpCacheFs(cacheUrls, opts...)
+}
@@ -0,0 +1,19 @@
+//go:build linux || freebsd
+
+package entrypoint
+
+import (
+	"context"
+
+	"bazil.org/fuse"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-http-cachefs/pkg/fusefs"
+)
+
+func mountFs(ctx context.Context, cacheFs afero.Fs, config *MountConfig) error {
+	var options []fuse.MountOption
+	if config.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+	return fusefs.Mount(ctx, config.Mountpoint, fusefs.New(cacheFs, config.StoreDir), options...)
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !freebsd
+
+package entrypoint
+
+import (
+	"context"
+	"errors"
+	"runtime"
+
+	"github.com/spf13/afero"
+)
+
+func mountFs(ctx context.Context, cacheFs afero.Fs, config *MountConfig) error {
+	return errors.New("FUSE mounts are not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,281 @@
+//go:build linux || freebsd
+
+// Package fusefs serves a read-only afero filesystem, such as a NixHttpCacheFs,
+// as a FUSE filesystem.
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/spf13/afero"
+)
+
+// attrValid is how long the kernel may cache attributes. Store paths are immutable,
+// so this only bounds how stale the mount root can be.
+const attrValid = time.Minute
+
+// contextFs is implemented by filesystems whose operations can be cancelled, such
+// as a NixHttpCacheFs. FUSE requests are cancelled when the caller is interrupted.
+type contextFs interface {
+	OpenContext(ctx context.Context, name string) (afero.File, error)
+	LstatContext(ctx context.Context, name string) (os.FileInfo, error)
+	ReadlinkContext(ctx context.Context, name string) (string, error)
+}
+
+// FS is a FUSE filesystem serving the tree under root of an afero filesystem.
+type FS struct {
+	afs  afero.Fs
+	root string
+}
+
+// New returns a FUSE filesystem serving root of afs, typically the store directory
+// of a NixHttpCacheFs.
+func New(afs afero.Fs, root string) *FS {
+	return &FS{afs: afs, root: path.Clean(root)}
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return &node{fs: f, path: f.root}, nil
+}
+
+// Mount mounts the filesystem at mountpoint and serves it until it is unmounted
+// or ctx is cancelled.
+func Mount(ctx context.Context, mountpoint string, fsys *FS, options ...fuse.MountOption) error {
+	conn, err := fuse.Mount(mountpoint, append([]fuse.MountOption{
+		fuse.ReadOnly(),
+		fuse.FSName("nix-http-cachefs"),
+		fuse.Subtype("nix-http-cachefs"),
+	}, options...)...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = fuse.Unmount(mountpoint)
+		case <-done:
+		}
+	}()
+
+	return fs.Serve(conn, fsys)
+}
+
+func (f *FS) open(ctx context.Context, name string) (afero.File, error) {
+	if cfs, ok := f.afs.(contextFs); ok {
+		return cfs.OpenContext(ctx, name)
+	}
+	return f.afs.Open(name)
+}
+
+// inode derives the inode number of a path. Store paths are content addressed, so
+// hashing the path gives numbers which are stable across mounts. Inode 1 is the root.
+func (f *FS) inode(name string) uint64 {
+	if name == f.root {
+		return 1
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	ino := h.Sum64()
+	if ino <= 1 {
+		ino += 2
+	}
+	return ino
+}
+
+// node is a file, directory or symlink in the served filesystem.
+type node struct {
+	fs   *FS
+	path string
+	// finfo is the FileInfo from the Lookup which created the node. Store paths are
+	// immutable so it never needs refreshing, except for the root.
+	finfo os.FileInfo
+}
+
+func (n *node) lstat(ctx context.Context) (os.FileInfo, error) {
+	if n.finfo != nil {
+		return n.finfo, nil
+	}
+	if cfs, ok := n.fs.afs.(contextFs); ok {
+		return cfs.LstatContext(ctx, n.path)
+	}
+	if lstater, ok := n.fs.afs.(afero.Lstater); ok {
+		finfo, _, err := lstater.LstatIfPossible(n.path)
+		return finfo, err
+	}
+	return n.fs.afs.Stat(n.path)
+}
+
+func (n *node) Attr(ctx context.Context, a *fuse.Attr) error {
+	finfo, err := n.lstat(ctx)
+	if err != nil {
+		return toErrno(err)
+	}
+	a.Valid = attrValid
+	a.Inode = n.fs.inode(n.path)
+	a.Mode = fileMode(finfo.Mode())
+	a.Nlink = 1
+	if !finfo.IsDir() {
+		a.Size = uint64(finfo.Size())
+		a.Blocks = (a.Size + 511) / 512
+	}
+	a.Mtime = finfo.ModTime()
+	a.Ctime = finfo.ModTime()
+	a.Atime = finfo.ModTime()
+	return nil
+}
+
+func (n *node) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	child := &node{fs: n.fs, path: path.Join(n.path, name)}
+	finfo, err := child.lstat(ctx)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	child.finfo = finfo
+	return child, nil
+}
+
+// ReadDirAll lists the directory without stat'ing its entries, so listing the store
+// directory doesn't fetch a narinfo for every store path in it.
+func (n *node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	f, err := n.fs.open(ctx, n.path)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	defer f.Close()
+
+	var dirents []fuse.Dirent
+	if readDirrer, ok := f.(iofs.ReadDirFile); ok {
+		entries, err := readDirrer.ReadDir(-1)
+		if err != nil {
+			return nil, toErrno(err)
+		}
+		for _, entry := range entries {
+			dirents = append(dirents, n.dirent(entry.Name(), entry.Type()))
+		}
+		return dirents, nil
+	}
+
+	finfos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	for _, finfo := range finfos {
+		dirents = append(dirents, n.dirent(finfo.Name(), finfo.Mode()))
+	}
+	return dirents, nil
+}
+
+func (n *node) dirent(name string, mode os.FileMode) fuse.Dirent {
+	dirent := fuse.Dirent{Inode: n.fs.inode(path.Join(n.path, name)), Name: name, Type: fuse.DT_Unknown}
+	switch mode.Type() {
+	case 0:
+		dirent.Type = fuse.DT_File
+	case os.ModeDir:
+		dirent.Type = fuse.DT_Dir
+	case os.ModeSymlink:
+		dirent.Type = fuse.DT_Link
+	}
+	return dirent
+}
+
+func (n *node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	if cfs, ok := n.fs.afs.(contextFs); ok {
+		target, err := cfs.ReadlinkContext(ctx, n.path)
+		if err != nil {
+			return "", toErrno(err)
+		}
+		return target, nil
+	}
+	linkReader, ok := n.fs.afs.(afero.LinkReader)
+	if !ok {
+		return "", syscall.ENOTSUP
+	}
+	target, err := linkReader.ReadlinkIfPossible(n.path)
+	if err != nil {
+		return "", toErrno(err)
+	}
+	return target, nil
+}
+
+func (n *node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, syscall.EROFS
+	}
+	if req.Dir {
+		return n, nil
+	}
+	f, err := n.fs.open(ctx, n.path)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	// Store path contents never change, so the page cache can be kept between opens.
+	resp.Flags |= fuse.OpenKeepCache
+	return &handle{file: f}, nil
+}
+
+// handle is an open regular file.
+type handle struct {
+	file afero.File
+}
+
+func (h *handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := h.file.ReadAt(buf, req.Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return toErrno(err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+func (h *handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.file.Close()
+}
+
+// fileMode maps a NAR mode to the mode served over FUSE. NARs only record whether
+// a file is executable, so everything is read-only and only the exec bit varies.
+func fileMode(mode os.FileMode) os.FileMode {
+	switch {
+	case mode.IsDir():
+		return os.ModeDir | 0o555
+	case mode.Type() == os.ModeSymlink:
+		return os.ModeSymlink | 0o777
+	case mode&0o111 != 0:
+		return 0o555
+	default:
+		return 0o444
+	}
+}
+
+// toErrno converts an error from the afero filesystem into the errno FUSE returns.
+func toErrno(err error) error {
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return errno
+	case errors.Is(err, context.Canceled):
+		return syscall.EINTR
+	case errors.Is(err, iofs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, iofs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, iofs.ErrInvalid):
+		return syscall.EINVAL
+	default:
+		return syscall.EIO
+	}
+}
@@ -0,0 +1,178 @@
+//go:build linux || freebsd
+
+package fusefs
+
+import (
+	"context"
+	iofs "io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/samber/lo"
+	"github.com/spf13/afero"
+	nix_http_cachefs "github.com/wrouesnel/nix-http-cachefs"
+	"github.com/wrouesnel/nix-http-cachefs/pkg/testcache"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+const (
+	storeDir  = "/nix/store"
+	helloPath = "/nix/store/7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12"
+	drvPath   = "/nix/store/ci1f3qvj2i3bgr2wibfxl52cfw0wfks6-hello-2.12.drv"
+)
+
+type FuseSuite struct {
+	cache *testcache.Cache
+	fs    *FS
+}
+
+var _ = Suite(&FuseSuite{})
+
+func (s *FuseSuite) SetUpTest(c *C) {
+	s.cache = testcache.New()
+	s.cache.AddStorePath(helloPath, map[string]testcache.Entry{
+		"":             {Mode: iofs.ModeDir},
+		"bin":          {Mode: iofs.ModeDir},
+		"bin/hello":    {Mode: 0o555, Content: "#!elf"},
+		"bin/hi":       {Mode: iofs.ModeSymlink, Target: "hello"},
+		"share":        {Mode: iofs.ModeDir},
+		"share/README": {Mode: 0o444, Content: "hello world"},
+	})
+	s.fs = s.newFS(c)
+}
+
+func (s *FuseSuite) TearDownTest(c *C) {
+	s.cache.Close()
+}
+
+func (s *FuseSuite) newFS(c *C) *FS {
+	cacheFs, err := nix_http_cachefs.NewNixHttpCacheFs([]*url.URL{s.cache.URL()},
+		nix_http_cachefs.StorePaths(helloPath, drvPath))
+	c.Assert(err, IsNil)
+	return New(cacheFs, storeDir)
+}
+
+// lookup walks names from the root the way the kernel would.
+func (s *FuseSuite) lookup(c *C, fsys *FS, names ...string) fs.Node {
+	curr := lo.Must(fsys.Root())
+	for _, name := range names {
+		next, err := curr.(fs.NodeStringLookuper).Lookup(context.Background(), name)
+		c.Assert(err, IsNil, Commentf("lookup %s", name))
+		curr = next
+	}
+	return curr
+}
+
+func (s *FuseSuite) attr(c *C, n fs.Node) fuse.Attr {
+	var a fuse.Attr
+	c.Assert(n.Attr(context.Background(), &a), IsNil)
+	return a
+}
+
+func (s *FuseSuite) TestRootIsStoreDir(c *C) {
+	a := s.attr(c, lo.Must(s.fs.Root()))
+	c.Check(a.Inode, Equals, uint64(1))
+	c.Check(a.Mode, Equals, os.ModeDir|0o555)
+}
+
+func (s *FuseSuite) TestExecutableBit(c *C) {
+	c.Check(s.attr(c, s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "bin", "hello")).Mode,
+		Equals, os.FileMode(0o555))
+	c.Check(s.attr(c, s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "share", "README")).Mode,
+		Equals, os.FileMode(0o444))
+	c.Check(s.attr(c, s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "bin", "hi")).Mode,
+		Equals, os.ModeSymlink|0o777)
+}
+
+func (s *FuseSuite) TestStableInodes(c *C) {
+	names := []string{"7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "bin", "hello"}
+	first := s.attr(c, s.lookup(c, s.fs, names...))
+	// A separate filesystem instance stands in for a remount.
+	second := s.attr(c, s.lookup(c, s.newFS(c), names...))
+	c.Check(first.Inode, Equals, second.Inode)
+
+	other := s.attr(c, s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "share", "README"))
+	c.Check(other.Inode, Not(Equals), first.Inode)
+}
+
+func (s *FuseSuite) TestLazyStoreDirListing(c *C) {
+	dirents, err := lo.Must(s.fs.Root()).(fs.HandleReadDirAller).ReadDirAll(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(dirents, HasLen, 2)
+	c.Check(dirents[0].Name, Equals, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12")
+	c.Check(dirents[0].Type, Equals, fuse.DT_Dir)
+	c.Check(dirents[1].Name, Equals, "ci1f3qvj2i3bgr2wibfxl52cfw0wfks6-hello-2.12.drv")
+	c.Check(dirents[1].Type, Equals, fuse.DT_File)
+	// Listing the store directory must not look up every store path in it.
+	c.Check(s.cache.NarInfoRequests(), Equals, 0)
+	c.Check(dirents[0].Inode, Equals, s.attr(c, s.lookup(c, s.fs, dirents[0].Name)).Inode)
+}
+
+func (s *FuseSuite) TestReadDirWithinStorePath(c *C) {
+	dirents, err := s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "bin").(fs.HandleReadDirAller).
+		ReadDirAll(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(dirents, HasLen, 2)
+	c.Check(dirents[0].Name, Equals, "hello")
+	c.Check(dirents[0].Type, Equals, fuse.DT_File)
+	c.Check(dirents[1].Name, Equals, "hi")
+	c.Check(dirents[1].Type, Equals, fuse.DT_Link)
+}
+
+func (s *FuseSuite) TestOpenAndRead(c *C) {
+	n := s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "share", "README")
+	openResp := &fuse.OpenResponse{}
+	h, err := n.(fs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, openResp)
+	c.Assert(err, IsNil)
+	c.Check(openResp.Flags&fuse.OpenKeepCache, Equals, fuse.OpenKeepCache)
+
+	readResp := &fuse.ReadResponse{}
+	c.Assert(h.(fs.HandleReader).Read(context.Background(), &fuse.ReadRequest{Offset: 6, Size: 4096}, readResp), IsNil)
+	c.Check(string(readResp.Data), Equals, "world")
+	c.Assert(h.(fs.HandleReleaser).Release(context.Background(), &fuse.ReleaseRequest{}), IsNil)
+}
+
+func (s *FuseSuite) TestOpenForWriteIsRefused(c *C) {
+	n := s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "share", "README")
+	_, err := n.(fs.NodeOpener).Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	c.Assert(err, Equals, syscall.EROFS)
+}
+
+func (s *FuseSuite) TestReadlink(c *C) {
+	n := s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12", "bin", "hi")
+	target, err := n.(fs.NodeReadlinker).Readlink(context.Background(), &fuse.ReadlinkRequest{})
+	c.Assert(err, IsNil)
+	c.Check(target, Equals, "hello")
+}
+
+func (s *FuseSuite) TestLookupMissing(c *C) {
+	storePath := s.lookup(c, s.fs, "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12")
+	_, err := storePath.(fs.NodeStringLookuper).Lookup(context.Background(), "missing")
+	c.Check(err, Equals, syscall.ENOENT)
+}
+
+func (s *FuseSuite) TestLookupMissingStorePath(c *C) {
+	_, err := lo.Must(s.fs.Root()).(fs.NodeStringLookuper).Lookup(context.Background(), "00000000000000000000000000000000-missing")
+	c.Check(err, Equals, syscall.ENOENT)
+}
+
+func (s *FuseSuite) TestLookupUnauthorized(c *C) {
+	s.cache.Fail("/7rjj86a15146cq1d3qy068lml7n8ykzm.narinfo", http.StatusForbidden)
+	_, err := lo.Must(s.fs.Root()).(fs.NodeStringLookuper).Lookup(context.Background(), "7rjj86a15146cq1d3qy068lml7n8ykzm-hello-2.12")
+	c.Check(err, Equals, syscall.EACCES)
+}
+
+func (s *FuseSuite) TestNonFuseFilesystem(c *C) {
+	memFs := afero.NewMemMapFs()
+	c.Assert(afero.WriteFile(memFs, "/root/tool", []byte("x"), 0o755), IsNil)
+	fsys := New(memFs, "/root")
+	c.Check(s.attr(c, s.lookup(c, fsys, "tool")).Mode, Equals, os.FileMode(0o555))
+}
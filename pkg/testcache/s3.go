@@ -0,0 +1,141 @@
+package testcache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+)
+
+// The access key an S3 Cache accepts requests signed with.
+const (
+	S3AccessKeyID     = "AKIATESTCACHE"
+	S3SecretAccessKey = "testcache/secret/access/key"
+)
+
+// NewS3 starts a Cache served as bucket of an S3-compatible object store in
+// region, like MinIO. Requests must be signed with AWS Signature Version 4 using
+// S3AccessKeyID and S3SecretAccessKey. Paths seen by the Cache are relative to the
+// bucket. It must be closed when finished.
+func NewS3(bucket string, region string) *Cache {
+	tc := New()
+	tc.Server.Close()
+	tc.bucket = bucket
+	tc.region = region
+	tc.Server = httptest.NewServer(http.HandlerFunc(tc.serveS3))
+	return tc
+}
+
+// s3Url is the s3:// URL of a Cache started by NewS3.
+func (tc *Cache) s3Url() *url.URL {
+	query := url.Values{}
+	query.Set("region", tc.region)
+	query.Set("endpoint", tc.Server.URL)
+	return &url.URL{Scheme: "s3", Host: tc.bucket, RawQuery: query.Encode()}
+}
+
+func (tc *Cache) serveS3(w http.ResponseWriter, r *http.Request) {
+	if err := tc.checkSignature(r); err != nil {
+		s3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	key, found := strings.CutPrefix(r.URL.Path, "/"+tc.bucket+"/")
+	if !found {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	objectRequest := r.Clone(r.Context())
+	objectRequest.URL.Path = "/" + key
+	objectRequest.URL.RawPath = ""
+	tc.serveHTTP(w, objectRequest)
+}
+
+// checkSignature checks r carries a valid AWS Signature Version 4.
+func (tc *Cache) checkSignature(r *http.Request) error {
+	fields, found := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !found {
+		return errors.New("request is not signed")
+	}
+	params := map[string]string{}
+	for _, field := range strings.Split(fields, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		params[key] = value
+	}
+
+	credential := strings.Split(params["Credential"], "/")
+	if len(credential) != 5 || credential[0] != S3AccessKeyID || credential[2] != tc.region ||
+		credential[3] != "s3" || credential[4] != "aws4_request" {
+		return fmt.Errorf("invalid credential: %s", params["Credential"])
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if !strings.HasPrefix(amzDate, credential[1]) {
+		return fmt.Errorf("credential date doesn't match X-Amz-Date: %s", amzDate)
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != "UNSIGNED-PAYLOAD" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+		if hex.EncodeToString(bodyHash[:]) != payloadHash {
+			return errors.New("body doesn't match X-Amz-Content-Sha256")
+		}
+	}
+
+	signedHeaders := strings.Split(params["SignedHeaders"], ";")
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, value)
+	}
+	for _, required := range []string{"host", "x-amz-date", "x-amz-content-sha256"} {
+		if !strings.Contains(";"+params["SignedHeaders"]+";", ";"+required+";") {
+			return fmt.Errorf("%s is not signed", required)
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method, r.URL.EscapedPath(), r.URL.RawQuery, canonicalHeaders.String(), params["SignedHeaders"], payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, strings.Join(credential[1:], "/"), hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + S3SecretAccessKey)
+	for _, part := range credential[1:] {
+		key = hmacSha256(key, part)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSha256(key, stringToSign))), []byte(params["Signature"])) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error writes an error response in the form S3 sends them.
+func s3Error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<Error><Code>%s</Code><Message>%s</Message></Error>\n",
+		code, message)
+}
@@ -0,0 +1,510 @@
+// Package testcache is a complete nix binary cache served from memory over HTTP,
+// for testing binary cache clients without network access. NARs are built from
+// a description of their contents, so tests can publish any store path they need.
+package testcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/archives"
+	"github.com/samber/lo"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"zombiezen.com/go/nix/nar"
+)
+
+// Compressions are the NAR compressions a Cache can serve.
+var Compressions = []string{"none", "xz", "bzip2", "gzip", "zstd", "br", "lz4", "lzip"} //nolint:gochecknoglobals
+
+// Entry describes a single file system object inside a NAR.
+type Entry struct {
+	Mode    fs.FileMode
+	Content string
+	Target  string
+}
+
+// ListingMode controls how a Cache serves .ls listings.
+type ListingMode int
+
+const (
+	// ListingsNone serves no listings, like most self-hosted caches.
+	ListingsNone ListingMode = iota
+	// ListingsPlain serves uncompressed JSON listings.
+	ListingsPlain
+	// ListingsBrotliEncoded serves brotli listings with a Content-Encoding header.
+	ListingsBrotliEncoded
+	// ListingsBrotliRaw serves brotli listings with no header, as S3 backed caches do.
+	ListingsBrotliRaw
+)
+
+// StorePath is a store path served by a Cache.
+type StorePath struct {
+	StorePath string
+	// NarBytes is the uncompressed NAR.
+	NarBytes []byte
+	// FileBytes is the NAR as served, compressed as the narinfo says.
+	FileBytes []byte
+	NarInfo   *nixtypes.NarInfo
+
+	cache *Cache
+}
+
+// NarInfoPath is the request path of the store path's narinfo.
+func (sp *StorePath) NarInfoPath() string {
+	return "/" + hashPart(sp.StorePath) + ".narinfo"
+}
+
+// NarPath is the request path of the store path's NAR.
+func (sp *StorePath) NarPath() string {
+	return "/" + sp.NarInfo.URL
+}
+
+// Corrupt flips a byte of the first regular file in the NAR and re-compresses it,
+// leaving the narinfo unchanged. The NAR still parses but fails verification.
+func (sp *StorePath) Corrupt() {
+	sp.cache.mu.Lock()
+	defer sp.cache.mu.Unlock()
+
+	listing := lo.Must(nar.List(bytes.NewReader(sp.NarBytes)))
+	offset := firstContentOffset(&listing.Root)
+	if offset == 0 {
+		panic("testcache: no regular file content to corrupt in " + sp.StorePath)
+	}
+	sp.NarBytes = bytes.Clone(sp.NarBytes)
+	sp.NarBytes[offset] ^= 0xff
+	sp.FileBytes = compress(sp.NarInfo.Compression, sp.NarBytes)
+}
+
+// Truncate cuts the served NAR file in half, as an interrupted upload would.
+func (sp *StorePath) Truncate() {
+	sp.cache.mu.Lock()
+	defer sp.cache.mu.Unlock()
+	sp.FileBytes = sp.FileBytes[:len(sp.FileBytes)/2]
+}
+
+// PathOpt configures a store path added to a Cache.
+type PathOpt func(*pathOptions)
+
+type pathOptions struct {
+	compression string
+	keys        []nixtypes.NamedPrivateKey
+	narUrl      string
+}
+
+// Compression serves the NAR compressed with one of Compressions.
+func Compression(compression string) PathOpt {
+	return func(opt *pathOptions) {
+		opt.compression = compression
+	}
+}
+
+// NarURL gives the narinfo narUrl as the URL of the NAR, rather than a path on the
+// cache named by its hash. The NAR is only served if narUrl is a path on the cache.
+func NarURL(narUrl string) PathOpt {
+	return func(opt *pathOptions) {
+		opt.narUrl = narUrl
+	}
+}
+
+// SignedBy signs the narinfo with each of keys.
+func SignedBy(keys ...nixtypes.NamedPrivateKey) PathOpt {
+	return func(opt *pathOptions) {
+		opt.keys = append(opt.keys, keys...)
+	}
+}
+
+// Cache is an in-memory nix binary cache served over HTTP.
+type Cache struct {
+	*httptest.Server
+
+	// StoreDir is the store directory advertised in nix-cache-info.
+	StoreDir string
+	// Priority is the priority advertised in nix-cache-info.
+	Priority int
+	// Delay is applied to every response other than nix-cache-info.
+	Delay time.Duration
+	// Listings sets how .ls listings are served.
+	Listings ListingMode
+	// RetryAfter, if set, is sent as the Retry-After header of failed requests.
+	RetryAfter string
+	// IgnoreRanges makes NAR requests answer with the whole file, as servers
+	// without Range support do.
+	IgnoreRanges bool
+	// MisplaceRanges makes Range requests for NARs answer with the first byte of
+	// the file, whatever was asked for, as a misbehaving proxy might.
+	MisplaceRanges bool
+
+	// bucket and region are set for a Cache served as an S3 bucket.
+	bucket string
+	region string
+
+	mu       sync.Mutex
+	paths    map[string]*StorePath
+	failures map[string]int
+	// failuresLeft counts down the failures of requests made to fail a number of times.
+	failuresLeft map[string]int
+	// interrupts counts down the responses to cut off partway through.
+	interrupts map[string]int
+	// uploads are the files uploaded with PUT, which are served like any other.
+	uploads  map[string][]byte
+	requests []string
+	ranges   []string
+}
+
+// New starts a Cache serving no store paths. It must be closed when finished.
+func New() *Cache {
+	tc := &Cache{
+		StoreDir:     "/nix/store",
+		Priority:     40,
+		paths:        map[string]*StorePath{},
+		failures:     map[string]int{},
+		failuresLeft: map[string]int{},
+		interrupts:   map[string]int{},
+		uploads:      map[string][]byte{},
+	}
+	tc.Server = httptest.NewServer(http.HandlerFunc(tc.serveHTTP))
+	return tc
+}
+
+// URL is the URL of the cache, as given to a binary cache client.
+func (tc *Cache) URL() *url.URL {
+	if tc.bucket != "" {
+		return tc.s3Url()
+	}
+	return lo.Must(url.Parse(tc.Server.URL + "/"))
+}
+
+// Requests returns the request paths seen so far.
+func (tc *Cache) Requests() []string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return append([]string{}, tc.requests...)
+}
+
+// NarInfoRequests returns the number of narinfo requests seen so far.
+func (tc *Cache) NarInfoRequests() int {
+	return len(lo.Filter(tc.Requests(), func(item string, _ int) bool {
+		return strings.HasSuffix(item, ".narinfo")
+	}))
+}
+
+// NarRequests returns the number of NAR requests seen so far.
+func (tc *Cache) NarRequests() int {
+	return len(lo.Filter(tc.Requests(), func(item string, _ int) bool {
+		return strings.HasPrefix(item, "/nar/")
+	}))
+}
+
+// Ranges returns the Range headers seen so far.
+func (tc *Cache) Ranges() []string {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return append([]string{}, tc.ranges...)
+}
+
+// Fail makes requests for reqPath fail with status. A status of 0 restores it.
+func (tc *Cache) Fail(reqPath string, status int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if status == 0 {
+		delete(tc.failures, reqPath)
+		return
+	}
+	tc.failures[reqPath] = status
+}
+
+// FailTimes makes the next times requests for reqPath fail with status, after
+// which they succeed again.
+func (tc *Cache) FailTimes(reqPath string, status int, times int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.failures[reqPath] = status
+	tc.failuresLeft[reqPath] = times
+}
+
+// Interrupt makes the next times responses for reqPath which aren't Range requests
+// drop the connection halfway through the body, as a flaky network would.
+func (tc *Cache) Interrupt(reqPath string, times int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.interrupts[reqPath] = times
+}
+
+// Uploaded returns the file uploaded to reqPath, if there was one.
+func (tc *Cache) Uploaded(reqPath string) ([]byte, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	content, found := tc.uploads[reqPath]
+	return content, found
+}
+
+// AddStorePath builds a NAR from entries and publishes it under storePath,
+// uncompressed unless a Compression is given. An entry at "" makes the NAR root
+// a single file. Adding a store path again replaces it.
+func (tc *Cache) AddStorePath(storePath string, entries map[string]Entry, opt ...PathOpt) *StorePath {
+	opts := &pathOptions{compression: "none"}
+	for _, o := range opt {
+		o(opts)
+	}
+
+	narBytes := BuildNar(entries)
+	fileBytes := compress(opts.compression, narBytes)
+	narHash := sha256.Sum256(narBytes)
+	fileHash := sha256.Sum256(fileBytes)
+
+	narFile := fmt.Sprintf("nar/%s.nar%s", nixtypes.NixBase32Field(fileHash[:]).String(), extension(opts.compression))
+	if opts.narUrl != "" {
+		narFile = opts.narUrl
+	}
+	ninfo := &nixtypes.NarInfo{
+		StorePath:   storePath,
+		URL:         narFile,
+		Compression: opts.compression,
+		FileHash:    nixtypes.TypedNixHash{HashName: "sha256", Hash: fileHash[:]},
+		FileSize:    uint64(len(fileBytes)),
+		NarHash:     nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash[:]},
+		NarSize:     uint64(len(narBytes)),
+		References:  []string{},
+		Sig:         []nixtypes.NixSignature{},
+	}
+	for _, key := range opts.keys {
+		lo.Must2(ninfo.Sign(key))
+	}
+
+	sp := &StorePath{StorePath: storePath, NarBytes: narBytes, FileBytes: fileBytes, NarInfo: ninfo, cache: tc}
+	tc.mu.Lock()
+	tc.paths[storePath] = sp
+	tc.mu.Unlock()
+	return sp
+}
+
+// Export writes the cache to dir as nix copy --to file://dir would, so it can be
+// read as a local binary cache. Listings are written unless Listings is
+// ListingsNone, and uploads are written too.
+func (tc *Cache) Export(dir string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	files := map[string][]byte{
+		"nix-cache-info": []byte(fmt.Sprintf("StoreDir: %s\nWantMassQuery: 1\nPriority: %d\n", tc.StoreDir, tc.Priority)),
+	}
+	for _, sp := range tc.paths {
+		files[hashPart(sp.StorePath)+".narinfo"] = lo.Must(sp.NarInfo.MarshalText())
+		files[sp.NarInfo.URL] = sp.FileBytes
+		if tc.Listings != ListingsNone {
+			listing := lo.Must(nar.List(bytes.NewReader(sp.NarBytes)))
+			files[hashPart(sp.StorePath)+nar.ListingExtension] = lo.Must(listing.MarshalJSON())
+		}
+	}
+	for uploadPath, content := range tc.uploads {
+		files[strings.TrimPrefix(uploadPath, "/")] = content
+	}
+
+	for name, content := range files {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filePath, content, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tc *Cache) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	tc.mu.Lock()
+	tc.requests = append(tc.requests, r.URL.Path)
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		tc.ranges = append(tc.ranges, rangeHeader)
+	}
+	status, failed := tc.failures[r.URL.Path]
+	if left, counted := tc.failuresLeft[r.URL.Path]; failed && counted {
+		if left <= 1 {
+			delete(tc.failures, r.URL.Path)
+			delete(tc.failuresLeft, r.URL.Path)
+		} else {
+			tc.failuresLeft[r.URL.Path] = left - 1
+		}
+	}
+	interrupt := false
+	if left := tc.interrupts[r.URL.Path]; left > 0 && r.Header.Get("Range") == "" {
+		interrupt = true
+		tc.interrupts[r.URL.Path] = left - 1
+	}
+	tc.mu.Unlock()
+
+	if failed {
+		if tc.RetryAfter != "" {
+			w.Header().Set("Retry-After", tc.RetryAfter)
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tc.mu.Lock()
+		tc.uploads[r.URL.Path] = content
+		tc.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	reqPath := strings.TrimPrefix(r.URL.Path, "/")
+	if reqPath == "nix-cache-info" {
+		_, _ = fmt.Fprintf(w, "StoreDir: %s\nWantMassQuery: 1\nPriority: %d\n", tc.StoreDir, tc.Priority)
+		return
+	}
+
+	time.Sleep(tc.Delay)
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if content, found := tc.uploads[r.URL.Path]; found {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		return
+	}
+	for _, sp := range tc.paths {
+		switch reqPath {
+		case hashPart(sp.StorePath) + ".narinfo":
+			ninfoBytes := lo.Must(sp.NarInfo.MarshalText())
+			w.Header().Set("Content-Type", "text/x-nix-narinfo")
+			_, _ = w.Write(ninfoBytes)
+			return
+		case sp.NarInfo.URL:
+			if interrupt {
+				// Promise the whole file, send half and hang up.
+				w.Header().Set("Content-Length", fmt.Sprint(len(sp.FileBytes)))
+				_, _ = w.Write(sp.FileBytes[:len(sp.FileBytes)/2])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			if tc.IgnoreRanges {
+				r.Header.Del("Range")
+			}
+			if tc.MisplaceRanges && r.Header.Get("Range") != "" {
+				r.Header.Set("Range", "bytes=0-0")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(sp.FileBytes))
+			return
+		case hashPart(sp.StorePath) + nar.ListingExtension:
+			if tc.Listings == ListingsNone {
+				continue
+			}
+			listing := lo.Must(nar.List(bytes.NewReader(sp.NarBytes)))
+			listingBytes := lo.Must(listing.MarshalJSON())
+			if tc.Listings == ListingsPlain {
+				_, _ = w.Write(listingBytes)
+				return
+			}
+			if tc.Listings == ListingsBrotliEncoded {
+				w.Header().Set("Content-Encoding", "br")
+			}
+			bw := lo.Must(new(archives.Brotli).OpenWriter(w))
+			_, _ = bw.Write(listingBytes)
+			_ = bw.Close()
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// BuildNar serializes entries into a NAR in the lexical order the writer requires.
+func BuildNar(entries map[string]Entry) []byte {
+	names := lo.Keys(entries)
+	sort.Strings(names)
+
+	buf := new(bytes.Buffer)
+	nw := nar.NewWriter(buf)
+	for _, name := range names {
+		entry := entries[name]
+		hdr := &nar.Header{Path: name, Mode: entry.Mode, LinkTarget: entry.Target}
+		if entry.Mode.Type() == 0 {
+			hdr.Size = int64(len(entry.Content))
+		}
+		lo.Must0(nw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			lo.Must(nw.Write([]byte(entry.Content)))
+		}
+	}
+	lo.Must0(nw.Close())
+	return buf.Bytes()
+}
+
+func hashPart(storePath string) string {
+	hash, _, _ := strings.Cut(path.Base(storePath), "-")
+	return hash
+}
+
+func compressor(compression string) archives.Compressor {
+	switch compression {
+	case "none":
+		return nil
+	case "xz":
+		return new(archives.Xz)
+	case "bzip2":
+		return new(archives.Bz2)
+	case "gzip":
+		return new(archives.Gz)
+	case "zstd":
+		return new(archives.Zstd)
+	case "br":
+		return new(archives.Brotli)
+	case "lz4":
+		return new(archives.Lz4)
+	case "lzip":
+		return new(archives.Lzip)
+	}
+	panic("testcache: unknown compression " + compression)
+}
+
+func extension(compression string) string {
+	if c := compressor(compression); c != nil {
+		return c.(archives.Format).Extension()
+	}
+	return ""
+}
+
+func compress(compression string, narBytes []byte) []byte {
+	c := compressor(compression)
+	if c == nil {
+		return narBytes
+	}
+	buf := new(bytes.Buffer)
+	cw := lo.Must(c.OpenWriter(buf))
+	lo.Must(io.Copy(cw, bytes.NewReader(narBytes)))
+	lo.Must0(cw.Close())
+	return buf.Bytes()
+}
+
+// firstContentOffset finds the content of the first non-empty regular file.
+func firstContentOffset(node *nar.ListingNode) int64 {
+	if node.Mode.Type() == 0 && node.Size > 0 {
+		return node.ContentOffset
+	}
+	names := lo.Keys(node.Entries)
+	sort.Strings(names)
+	for _, name := range names {
+		if offset := firstContentOffset(node.Entries[name]); offset != 0 {
+			return offset
+		}
+	}
+	return 0
+}
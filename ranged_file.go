@@ -0,0 +1,267 @@
+package nix_http_cachefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/nix/nar"
+)
+
+// rangeReadAhead is the minimum amount fetched by a sequential Read, so callers
+// reading in small chunks don't issue one HTTP request per chunk.
+const rangeReadAhead = 256 * 1024
+
+// rangedFile serves a single regular file out of an uncompressed NAR on a binary
+// cache using HTTP Range requests, so only the bytes actually read are downloaded.
+// Ranges can't be checked against the NarHash, so they are only used when
+// signatures aren't required. If the server turns out not to support ranges, or
+// sends a range other than the one asked for, the whole NAR is fetched and
+// verified, and the file is read from that instead.
+// It implements fs.File, io.ReaderAt and io.Seeker so it can back a narchivedFile.
+type rangedFile struct {
+	fs     *nixHttpCacheFs
+	ninfo  *ninfoWithOrigin
+	within string
+	narUrl string
+	finfo  fs.FileInfo
+	// contentOffset is where the file's content begins in the NAR.
+	contentOffset int64
+	size          int64
+
+	mu sync.Mutex
+	// offset is the position of the next Read.
+	offset int64
+	// buf holds read-ahead data starting at bufOffset.
+	buf       []byte
+	bufOffset int64
+
+	fullMu sync.Mutex
+	// full is the NAR fetched in place of ranges, and fullFile the file in it.
+	full     *sharedNar
+	fullFile io.ReaderAt
+}
+
+func newRangedFile(fs *nixHttpCacheFs, ninfo *ninfoWithOrigin, within string, narUrl string, finfo fs.FileInfo, hdr *nar.Header) *rangedFile {
+	return &rangedFile{
+		fs:            fs,
+		ninfo:         ninfo,
+		within:        within,
+		narUrl:        narUrl,
+		finfo:         finfo,
+		contentOffset: hdr.ContentOffset,
+		size:          hdr.Size,
+	}
+}
+
+func (r *rangedFile) Stat() (fs.FileInfo, error) {
+	return r.finfo, nil
+}
+
+func (r *rangedFile) Close() error {
+	r.fullMu.Lock()
+	defer r.fullMu.Unlock()
+	if r.full != nil {
+		r.full.release()
+		r.full, r.fullFile = nil, nil
+	}
+	return nil
+}
+
+// openFull fetches and verifies the whole NAR, and returns the file within it.
+func (r *rangedFile) openFull() (io.ReaderAt, error) {
+	r.fullMu.Lock()
+	defer r.fullMu.Unlock()
+	if r.fullFile != nil {
+		return r.fullFile, nil
+	}
+
+	// Reads aren't bound by the context the file was opened with.
+	shared, err := r.fs.openNar(context.Background(), r.ninfo)
+	if err != nil {
+		return nil, err
+	}
+	narfs, err := nar.NewFS(shared.file, shared.listing)
+	if err != nil {
+		shared.release()
+		return nil, err
+	}
+	fh, err := narfs.Open(r.within)
+	if err != nil {
+		shared.release()
+		return nil, err
+	}
+	readerAt, ok := fh.(io.ReaderAt)
+	if !ok {
+		fh.Close()
+		shared.release()
+		return nil, fmt.Errorf("%s is not a regular file", r.within)
+	}
+	r.full, r.fullFile = shared, readerAt
+	return readerAt, nil
+}
+
+// readFull reads length bytes of the file's content starting at off from the
+// verified NAR.
+func (r *rangedFile) readFull(off int64, length int64) ([]byte, error) {
+	readerAt, err := r.openFull()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if n, err := readerAt.ReadAt(data, off); int64(n) < length {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fetch retrieves length bytes of the file's content starting at off.
+func (r *rangedFile) fetch(off int64, length int64) ([]byte, error) {
+	r.fullMu.Lock()
+	full := r.fullFile != nil
+	r.fullMu.Unlock()
+	if full {
+		return r.readFull(off, length)
+	}
+
+	start := r.contentOffset + off
+	end := start + length - 1
+
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end)
+	r.fs.debugLog("HTTP Request", http.MethodGet, r.narUrl, rangeHeader)
+
+	// Reads aren't bound by the context the file was opened with. The request is
+	// only cancelled if the response is kept for the download of the NAR.
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := r.fs.get(ctx, r.ninfo.cacheUrl, r.narUrl, http.Header{"Range": {rangeHeader}})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		defer cancel()
+		defer resp.Body.Close()
+		if contentRange := resp.Header.Get("Content-Range"); !contentRangeIs(contentRange, start, end) {
+			// Whatever was sent can't be relied on to be what was asked for, so
+			// the file is read from the verified NAR instead.
+			r.fs.debugLog("rangedFile", "server sent the wrong range", r.narUrl, contentRange)
+			return r.readFull(off, length)
+		}
+	case http.StatusOK:
+		// The server ignored the Range header and is sending the whole NAR. Rather
+		// than download it again for every read, it is kept for the verified
+		// download of the NAR to carry on from.
+		r.fs.debugLog("rangedFile", "server does not support ranges", r.narUrl)
+		r.fs.peeks.keep(r.narUrl, &peekedNar{resp: resp, cancel: cancel})
+		return r.readFull(off, length)
+	default:
+		resp.Body.Close()
+		cancel()
+		kind := statusKind(resp.StatusCode)
+		if kind == nil {
+			// No other success status can carry the range we asked for.
+			kind = ErrCorrupt
+		}
+		return nil, &CacheError{URL: r.narUrl, Kind: kind, Err: errors.New(resp.Status)}
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, errors.Join(errors.New("short range read"), err)
+	}
+	return data, nil
+}
+
+func (r *rangedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	length := min(int64(len(p)), r.size-off)
+	data, err := r.fetch(off, length)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	if int64(n) < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *rangedFile) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	// Serve from the read-ahead buffer if it covers the current offset.
+	if r.offset < r.bufOffset || r.offset >= r.bufOffset+int64(len(r.buf)) {
+		length := min(max(int64(len(p)), rangeReadAhead), r.size-r.offset)
+		data, err := r.fetch(r.offset, length)
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+		r.bufOffset = r.offset
+	}
+
+	n := copy(p, r.buf[r.offset-r.bufOffset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *rangedFile) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// contentRangeIs reports whether a Content-Range header covers exactly the bytes
+// from start to end inclusive.
+func contentRangeIs(contentRange string, start int64, end int64) bool {
+	spec, found := strings.CutPrefix(contentRange, "bytes ")
+	if !found {
+		return false
+	}
+	spec, _, found = strings.Cut(spec, "/")
+	if !found {
+		return false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return false
+	}
+	firstByte, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || firstByte != start {
+		return false
+	}
+	lastByte, err := strconv.ParseInt(last, 10, 64)
+	return err == nil && lastByte == end
+}
@@ -0,0 +1,175 @@
+package nix_http_cachefs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"zombiezen.com/go/nix/nar"
+)
+
+// maxSymlinkHops bounds symlink resolution, matching Linux's MAXSYMLINKS.
+const maxSymlinkHops = 40
+
+// resolvedPath is a name with every symlink along it resolved, down to the node
+// of the store path's NAR it refers to.
+type resolvedPath struct {
+	storePath string
+	// within is the path of the node within the NAR, "." for the root.
+	within string
+	node   *nar.ListingNode
+	// listing is nil if only the root header of the NAR was needed.
+	listing *nar.Listing
+	// ninfo is nil if the path was resolved entirely from cached listings.
+	ninfo *ninfoWithOrigin
+}
+
+// resolver follows symlinks through store paths, including links which point into
+// other store paths. It holds a reference on any NAR it had to open to get a listing
+// so the caller can reuse it - release must be called when finished.
+type resolver struct {
+	ctx  context.Context
+	fs   *nixHttpCacheFs
+	held []*sharedNar
+	hops int
+}
+
+func (fs *nixHttpCacheFs) newResolver(ctx context.Context) *resolver {
+	return &resolver{ctx: ctx, fs: fs}
+}
+
+func (r *resolver) release() {
+	for _, shared := range r.held {
+		shared.release()
+	}
+	r.held = nil
+}
+
+// narInfo returns the narinfo for the resolved path, fetching it if resolution
+// didn't need it.
+func (r *resolver) narInfo(resolved *resolvedPath) (*ninfoWithOrigin, error) {
+	if resolved.ninfo != nil {
+		return resolved.ninfo, nil
+	}
+	ninfo, err := r.fs.getNarInfo(r.ctx, resolved.storePath)
+	if err != nil {
+		return nil, err
+	}
+	resolved.ninfo = ninfo
+	return ninfo, nil
+}
+
+// listing returns the listing for storePath, downloading the NAR only if neither a
+// cached listing nor a .ls listing is available.
+func (r *resolver) listing(storePath string) (*nar.Listing, *ninfoWithOrigin, error) {
+	if listing, ok := r.fs.listings.getListing(storePath); ok {
+		return listing, nil, nil
+	}
+	ninfo, err := r.fs.getNarInfo(r.ctx, storePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if listing, ok := r.fs.getListing(r.ctx, ninfo); ok {
+		return listing, ninfo, nil
+	}
+	shared, err := r.fs.openNar(r.ctx, ninfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.held = append(r.held, shared)
+	return shared.listing, ninfo, nil
+}
+
+// rootHeader returns the header of the root of storePath, which only needs the
+// start of the NAR if no listing is available.
+func (r *resolver) rootHeader(storePath string) (nar.Header, *ninfoWithOrigin, error) {
+	if hdr, ok := r.fs.listings.getRoot(storePath); ok {
+		return hdr, nil, nil
+	}
+	ninfo, err := r.fs.getNarInfo(r.ctx, storePath)
+	if err != nil {
+		return nar.Header{}, nil, err
+	}
+	hdr, err := r.fs.rootHeader(r.ctx, ninfo)
+	return hdr, ninfo, err
+}
+
+// resolve resolves every symlink in name. The final component is only followed if
+// followLast is set, as with stat vs lstat.
+func (r *resolver) resolve(name string, followLast bool) (*resolvedPath, error) {
+	storePath, within, ok := r.fs.splitStoreName(r.ctx, name)
+	if !ok {
+		// The store directory may be unknown because we gave up asking for it.
+		if err := r.ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fs.ErrNotExist
+	}
+
+	if within == "." {
+		hdr, ninfo, err := r.rootHeader(storePath)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Mode.Type() == fs.ModeSymlink && followLast {
+			return r.follow(path.Dir(storePath), hdr.LinkTarget, nil, followLast)
+		}
+		return &resolvedPath{storePath: storePath, within: within, node: &nar.ListingNode{Header: hdr}, ninfo: ninfo}, nil
+	}
+
+	listing, ninfo, err := r.listing(storePath)
+	if err != nil {
+		return nil, err
+	}
+
+	components := strings.Split(within, "/")
+	curr := &listing.Root
+	if curr.Mode.Type() == fs.ModeSymlink {
+		return r.follow(path.Dir(storePath), curr.LinkTarget, components, followLast)
+	}
+	for idx, component := range components {
+		if !curr.Mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		next := curr.Entries[component]
+		if next == nil {
+			return nil, fs.ErrNotExist
+		}
+		last := idx == len(components)-1
+		if next.Mode.Type() == fs.ModeSymlink && (!last || followLast) {
+			return r.follow(path.Join(storePath, curr.Path), next.LinkTarget, components[idx+1:], followLast)
+		}
+		curr = next
+	}
+	return &resolvedPath{storePath: storePath, within: within, node: curr, listing: listing, ninfo: ninfo}, nil
+}
+
+// follow resolves a symlink target found in linkDir, followed by the rest of the path.
+// Absolute targets are resolved through the filesystem, so links into other store
+// paths fetch those store paths too.
+func (r *resolver) follow(linkDir string, target string, rest []string, followLast bool) (*resolvedPath, error) {
+	r.hops++
+	if r.hops > maxSymlinkHops {
+		return nil, syscall.ELOOP
+	}
+	if !path.IsAbs(target) {
+		target = path.Join(linkDir, target)
+	}
+	return r.resolve(path.Join(append([]string{target}, rest...)...), followLast)
+}
+
+// fileInfo returns the FileInfo for a resolved path. Store path roots report the
+// store path name, and directories the NarSize.
+func (r *resolver) fileInfo(resolved *resolvedPath) (os.FileInfo, error) {
+	if resolved.within != "." {
+		return resolved.node.FileInfo(), nil
+	}
+	ninfo, err := r.narInfo(resolved)
+	if err != nil {
+		return nil, err
+	}
+	return rootFileInfo(resolved.storePath, ninfo.ninfo.NarSize, resolved.node.Header), nil
+}
@@ -0,0 +1,284 @@
+package nix_http_cachefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRetries is how many times a transient failure is retried.
+	defaultRetries = 3
+	// defaultRetryBaseDelay is the backoff before the first retry. It doubles with
+	// every retry, up to defaultRetryMaxDelay.
+	defaultRetryBaseDelay = 250 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+	// defaultBreakerThreshold is how many requests in a row must fail before a cache
+	// is skipped, and defaultBreakerCooldown how long it is skipped for.
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// errCacheUnhealthy is returned for requests to a cache the circuit breaker is skipping.
+var errCacheUnhealthy = errors.New("cache skipped after repeated failures")
+
+// retryableStatus reports whether a response status is worth retrying.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter parses the Retry-After header of a response, which is either a number
+// of seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// backoff returns how long to wait before retry number attempt (from zero). The
+// delay doubles with each attempt, and is jittered so clients which failed together
+// don't retry together.
+func (fs *nixHttpCacheFs) backoff(attempt int) time.Duration {
+	delay := fs.opts.retryMaxDelay
+	if attempt < 32 {
+		delay = min(fs.opts.retryBaseDelay<<attempt, fs.opts.retryMaxDelay)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1) //nolint:gosec
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// get requests uri from the cache at cacheUrl, retrying as retry does.
+func (fs *nixHttpCacheFs) get(ctx context.Context, cacheUrl *url.URL, uri string, header http.Header) (*http.Response, error) {
+	return fs.retry(ctx, cacheUrl, uri, func() (*http.Request, error) {
+		req, err := fs.newRequest(ctx, http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		return req, nil
+	})
+}
+
+// retry sends the request for uri made by newRequest to the cache at cacheUrl,
+// retrying connection errors and retryable statuses with backoff. Each attempt
+// sends a new request from newRequest. A Retry-After header is honoured, unless it
+// asks for a longer wait than the maximum backoff, in which case the response is
+// returned as is. The response is returned with whatever status it finally had, so
+// the caller still has to check it. Requests to a cache the circuit breaker is
+// skipping fail with errCacheUnhealthy.
+func (fs *nixHttpCacheFs) retry(ctx context.Context, cacheUrl *url.URL, uri string,
+	newRequest func() (*http.Request, error),
+) (*http.Response, error) {
+	if !fs.health.allow(cacheUrl) {
+		fs.debugLog("Skipping unhealthy cache", cacheUrl.String())
+		return nil, errCacheUnhealthy
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := fs.client.Do(req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+
+		delay := fs.backoff(attempt)
+		switch {
+		case err != nil:
+			fs.debugLog("HTTP Request failed", uri, err.Error())
+		case retryableStatus(resp.StatusCode):
+			fs.debugLog("HTTP Request failed", uri, resp.Status)
+			if after, found := retryAfter(resp); found {
+				if after > fs.opts.retryMaxDelay {
+					fs.health.failure(cacheUrl)
+					return resp, nil
+				}
+				delay = after
+			}
+		default:
+			// Anything else, including not found, means the cache is working.
+			fs.health.success(cacheUrl)
+			return resp, nil
+		}
+
+		if attempt >= fs.opts.retries {
+			fs.health.failure(cacheUrl)
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		fs.debugLog("HTTP Request retry", uri, delay.String())
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resumingBody reads the body of a response to a GET, resuming with a Range request
+// from where it stopped if the connection fails partway through.
+type resumingBody struct {
+	fs       *nixHttpCacheFs
+	ctx      context.Context
+	cacheUrl *url.URL
+	uri      string
+
+	body io.ReadCloser
+	// offset is how much of the body has been read.
+	offset  int64
+	resumes int
+}
+
+// resumable wraps the body of resp so it is resumed if the connection fails.
+func (fs *nixHttpCacheFs) resumable(ctx context.Context, cacheUrl *url.URL, uri string, resp *http.Response) io.ReadCloser {
+	// Offsets into a body the transport decompressed don't match the file on the cache.
+	if resp.Uncompressed {
+		return resp.Body
+	}
+	return &resumingBody{fs: fs, ctx: ctx, cacheUrl: cacheUrl, uri: uri, body: resp.Body}
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if err == nil || errors.Is(err, io.EOF) || b.ctx.Err() != nil || readKind(err) != ErrTransient {
+			return n, err
+		}
+		if resumeErr := b.resume(); resumeErr != nil {
+			return n, errors.Join(err, resumeErr)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resume replaces the failed body with the rest of it.
+func (b *resumingBody) resume() error {
+	if b.resumes >= b.fs.opts.retries {
+		return errors.New("too many resumes")
+	}
+	b.resumes++
+	b.body.Close()
+	b.body = io.NopCloser(strings.NewReader(""))
+
+	rangeHeader := fmt.Sprintf("bytes=%d-", b.offset)
+	b.fs.debugLog("HTTP Request resume", b.uri, rangeHeader)
+	resp, err := b.fs.get(b.ctx, b.cacheUrl, b.uri, http.Header{"Range": {rangeHeader}})
+	if err != nil {
+		return err
+	}
+	// A server ignoring the Range header would send the whole file again.
+	wantRange := fmt.Sprintf("bytes %d-", b.offset)
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), wantRange) {
+		resp.Body.Close()
+		return fmt.Errorf("can't resume: %s", resp.Status)
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+// cacheHealth is a circuit breaker for each cache. Once enough requests to a cache
+// fail in a row it is skipped for a cooldown period, after which requests are let
+// through again. The first of those to fail skips the cache again straight away.
+type cacheHealth struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu     sync.Mutex
+	caches map[string]*breakerState
+}
+
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newCacheHealth(threshold int, cooldown time.Duration) *cacheHealth {
+	return &cacheHealth{threshold: threshold, cooldown: cooldown, caches: map[string]*breakerState{}}
+}
+
+// allow reports whether requests should be made to the cache.
+func (h *cacheHealth) allow(cacheUrl *url.URL) bool {
+	if h.threshold <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, found := h.caches[cacheUrl.String()]
+	return !found || time.Now().After(state.openUntil)
+}
+
+func (h *cacheHealth) success(cacheUrl *url.URL) {
+	if h.threshold <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.caches, cacheUrl.String())
+}
+
+func (h *cacheHealth) failure(cacheUrl *url.URL) {
+	if h.threshold <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, found := h.caches[cacheUrl.String()]
+	if !found {
+		state = &breakerState{}
+		h.caches[cacheUrl.String()] = state
+	}
+	state.failures++
+	if state.failures >= h.threshold {
+		state.openUntil = time.Now().Add(h.cooldown)
+	}
+}
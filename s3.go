@@ -0,0 +1,324 @@
+package nix_http_cachefs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// s3Scheme is the URL scheme of binary caches stored in S3-compatible buckets.
+	s3Scheme = "s3"
+	// defaultS3Region is the region buckets are assumed to be in, as nix does.
+	defaultS3Region = "us-east-1"
+	// s3UnsignedPayload is signed in place of the hash of a request body, so bodies
+	// can be streamed rather than hashed before they are sent.
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// s3EmptyPayload is the hash of an empty request body.
+	s3EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat  = "20060102T150405Z"
+)
+
+// s3Credentials is an AWS access key, which signs requests to S3 buckets.
+type s3Credentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+// s3Bucket is the bucket an s3:// cache URL refers to, and where it is served.
+type s3Bucket struct {
+	name    string
+	region  string
+	profile string
+	scheme  string
+	host    string
+	// pathStyle buckets are addressed by the first path component rather than
+	// by their host name.
+	pathStyle bool
+}
+
+// parseS3Bucket reads the bucket from an s3://bucket?region=...&endpoint=... URL,
+// with the query parameters nix accepts. The endpoint is a host, or a URL whose
+// scheme overrides the scheme parameter. Buckets on a custom endpoint, such as
+// MinIO, are addressed path-style.
+func parseS3Bucket(u *url.URL) (*s3Bucket, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("s3 cache URL has no bucket: %s", u.Redacted())
+	}
+	query := u.Query()
+	bucket := &s3Bucket{
+		name:    u.Host,
+		region:  query.Get("region"),
+		profile: query.Get("profile"),
+		scheme:  query.Get("scheme"),
+	}
+	if bucket.region == "" {
+		bucket.region = defaultS3Region
+	}
+	if bucket.scheme == "" {
+		bucket.scheme = "https"
+	}
+
+	endpoint := query.Get("endpoint")
+	switch {
+	case endpoint == "":
+		bucket.host = fmt.Sprintf("s3.%s.amazonaws.com", bucket.region)
+		// Dotted bucket names don't match the wildcard certificate.
+		bucket.pathStyle = strings.Contains(bucket.name, ".")
+		if !bucket.pathStyle {
+			bucket.host = bucket.name + "." + bucket.host
+		}
+	case strings.Contains(endpoint, "://"):
+		parsed, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("invalid s3 endpoint: %s", endpoint), err)
+		}
+		bucket.scheme = parsed.Scheme
+		bucket.host = parsed.Host
+		bucket.pathStyle = true
+	default:
+		bucket.host = endpoint
+		bucket.pathStyle = true
+	}
+	return bucket, nil
+}
+
+// objectUrl returns the HTTP URL of the object at key.
+func (b *s3Bucket) objectUrl(key string) *url.URL {
+	objectPath := "/" + strings.TrimPrefix(key, "/")
+	if b.pathStyle {
+		objectPath = "/" + b.name + objectPath
+	}
+	return &url.URL{Scheme: b.scheme, Host: b.host, Path: objectPath, RawPath: s3Escape(objectPath, false)}
+}
+
+// s3RoundTripper serves s3:// URLs from S3-compatible object stores. Requests are
+// rewritten to the bucket's HTTP endpoint and signed with AWS Signature Version 4.
+// Requests for any other URL are passed through unchanged.
+type s3RoundTripper struct {
+	http.RoundTripper
+	// credentials, if set, sign requests to every bucket, rather than credentials
+	// looked up from the environment.
+	credentials *s3Credentials
+
+	mu sync.Mutex
+	// profiles caches the credentials looked up for each profile, or nil if there
+	// were none.
+	profiles map[string]*s3Credentials
+}
+
+func newS3RoundTripper(roundTripper http.RoundTripper, credentials *s3Credentials) *s3RoundTripper {
+	return &s3RoundTripper{RoundTripper: roundTripper, credentials: credentials, profiles: map[string]*s3Credentials{}}
+}
+
+func (t *s3RoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme != s3Scheme {
+		return t.RoundTripper.RoundTrip(request)
+	}
+	bucket, err := parseS3Bucket(request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := request.Clone(request.Context())
+	signed.URL = bucket.objectUrl(request.URL.Path)
+	signed.Host = signed.URL.Host
+	// Netrc credentials for the bucket name mean nothing to S3.
+	signed.Header.Del("Authorization")
+
+	// Public buckets can be read without credentials.
+	if credentials := t.credentialsFor(bucket.profile); credentials != nil {
+		payloadHash := s3UnsignedPayload
+		if request.Body == nil || request.Body == http.NoBody {
+			payloadHash = s3EmptyPayload
+		}
+		credentials.sign(signed, bucket.region, payloadHash, time.Now())
+	}
+	return t.RoundTripper.RoundTrip(signed)
+}
+
+// credentialsFor returns the credentials to sign requests to buckets using profile
+// with, or nil if there are none. Like the AWS CLI, the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables are used when
+// no profile is given, otherwise the profile is read from the shared credentials
+// file.
+func (t *s3RoundTripper) credentialsFor(profile string) *s3Credentials {
+	if t.credentials != nil {
+		return t.credentials
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if credentials, found := t.profiles[profile]; found {
+		return credentials
+	}
+
+	var credentials *s3Credentials
+	accessKeyID, secretAccessKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if profile == "" && accessKeyID != "" && secretAccessKey != "" {
+		credentials = &s3Credentials{
+			accessKeyID:     accessKeyID,
+			secretAccessKey: secretAccessKey,
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	} else {
+		credentials = sharedCredentials(profile)
+	}
+	t.profiles[profile] = credentials
+	return credentials
+}
+
+// sharedCredentials reads a profile from the AWS shared credentials file. The
+// profile defaults to AWS_PROFILE, and then to default.
+func sharedCredentials(profile string) *s3Credentials {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		credentialsFile = filepath.Join(home, ".aws", "credentials")
+	}
+
+	f, err := os.Open(credentialsFile)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	credentials := &s3Credentials{}
+	inProfile := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if section, found := strings.CutPrefix(line, "["); found {
+			inProfile = strings.TrimSpace(strings.TrimSuffix(section, "]")) == profile
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !inProfile || !found {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			credentials.accessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			credentials.secretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			credentials.sessionToken = strings.TrimSpace(value)
+		}
+	}
+	if credentials.accessKeyID == "" || credentials.secretAccessKey == "" {
+		return nil
+	}
+	return credentials
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to request, with
+// payloadHash as the hash of its body. The Host, Range and X-Amz-* headers are
+// signed.
+func (c *s3Credentials) sign(request *http.Request, region string, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		key = strings.ToLower(key)
+		if key == "range" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	headerNames := make([]string, 0, len(headers))
+	for key := range headers {
+		headerNames = append(headerNames, key)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := &strings.Builder{}
+	for _, key := range headerNames {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", key, headers[key])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		s3Escape(request.URL.Path, false),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		sigV4Algorithm, c.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query parameters sorted by name, as they are signed.
+func s3CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes everything but the characters AWS leaves unreserved,
+// and slashes unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	escaped := &strings.Builder{}
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !escapeSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
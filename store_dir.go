@@ -0,0 +1,281 @@
+package nix_http_cachefs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+)
+
+// knownStorePaths is the set of store paths the filesystem knows exist, used to
+// synthesize a listing of the store directory since binary caches can't list it.
+type knownStorePaths struct {
+	mu    sync.Mutex
+	paths map[string]*knownStorePath
+}
+
+// knownStorePath is what is known of a store path without looking it up.
+type knownStorePath struct {
+	// listed is set for store paths which were looked up or seeded, which are
+	// listed whichever caches are in use.
+	listed bool
+	// cacheDirs are the persistent cache directories its narinfo was found in.
+	cacheDirs map[string]struct{}
+	// narSize is the NarSize from its narinfo, or zero if none has been seen.
+	narSize uint64
+}
+
+func newKnownStorePaths(seed []string) *knownStorePaths {
+	k := &knownStorePaths{paths: make(map[string]*knownStorePath)}
+	for _, storePath := range seed {
+		k.add(storePath)
+	}
+	return k
+}
+
+// get returns the entry for a store path, creating it if need be. Only the base
+// name is kept, so seeds can be given as either full store paths or bare
+// <hash>-<name> names. The caller must hold mu.
+func (k *knownStorePaths) get(storePath string) *knownStorePath {
+	base := path.Base(storePath)
+	if base == "." || base == "/" {
+		return nil
+	}
+	known, found := k.paths[base]
+	if !found {
+		known = &knownStorePath{cacheDirs: map[string]struct{}{}}
+		k.paths[base] = known
+	}
+	return known
+}
+
+// add records a store path.
+func (k *knownStorePaths) add(storePath string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if known := k.get(storePath); known != nil {
+		known.listed = true
+	}
+}
+
+// addNarInfo records the store path of a narinfo which was looked up.
+func (k *knownStorePaths) addNarInfo(ninfo *nixtypes.NarInfo) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if known := k.get(ninfo.StorePath); known != nil {
+		known.listed = true
+		known.narSize = ninfo.NarSize
+	}
+}
+
+// addCached records the store path of a narinfo found in the persistent cache
+// directory of a binary cache.
+func (k *knownStorePaths) addCached(cacheDir string, ninfo *nixtypes.NarInfo) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if known := k.get(ninfo.StorePath); known != nil {
+		known.cacheDirs[cacheDir] = struct{}{}
+		known.narSize = ninfo.NarSize
+	}
+}
+
+// names returns the store paths which were looked up or seeded, or which were
+// found in one of cacheDirs.
+func (k *knownStorePaths) names(cacheDirs map[string]struct{}) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names := make([]string, 0, len(k.paths))
+	for name, known := range k.paths {
+		inUse := lo.SomeBy(lo.Keys(known.cacheDirs), func(cacheDir string) bool {
+			_, found := cacheDirs[cacheDir]
+			return found
+		})
+		if known.listed || inUse {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// narSize returns the NarSize of a store path, if a narinfo for it has been seen.
+func (k *knownStorePaths) narSize(name string) (uint64, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if known, found := k.paths[name]; found && known.narSize != 0 {
+		return known.narSize, true
+	}
+	return 0, false
+}
+
+// isStoreDir reports whether name refers to the store directory itself.
+func (fs *nixHttpCacheFs) isStoreDir(ctx context.Context, name string) bool {
+	storeDir := fs.getStoreDir(ctx)
+	return storeDir != "" && path.Clean(name) == storeDir
+}
+
+// storeDirNames returns the names of every store path we know about: those we have
+// resolved, those in the persistent cache of the caches in use, and any seeded by
+// the StorePaths option.
+func (fs *nixHttpCacheFs) storeDirNames(ctx context.Context) []string {
+	cacheDirs := map[string]struct{}{}
+	if fs.persistentCache != nil {
+		for _, cacheUrl := range fs.caches(ctx) {
+			cacheDirs[fs.persistentCache.cacheDirFor(cacheUrl)] = struct{}{}
+		}
+	}
+	names := fs.knownPaths.names(cacheDirs)
+	sort.Strings(names)
+	return names
+}
+
+// scanPersistentCache records the store paths of narinfos in the persistent cache.
+// Responses are cached under a directory per cache, so the whole tree is walked.
+// It is only done once, as the filesystem is created, since any narinfo cached
+// later was looked up by this filesystem and so is already known.
+func (fs *nixHttpCacheFs) scanPersistentCache() {
+	if fs.persistentCache == nil {
+		return
+	}
+	root := fs.persistentCache.PersistentCache
+	cacheFs := root.Fs()
+	err := afero.Walk(cacheFs, root.String(), func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(name, ".narinfo") {
+			return nil
+		}
+		rel, err := filepath.Rel(root.String(), name)
+		if err != nil {
+			return nil
+		}
+		cacheDir, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		ninfoBytes, err := afero.ReadFile(cacheFs, name)
+		if err != nil {
+			return nil
+		}
+		ninfo := new(nixtypes.NarInfo)
+		if err := ninfo.UnmarshalText(ninfoBytes); err != nil || ninfo.StorePath == "" {
+			return nil
+		}
+		fs.knownPaths.addCached(cacheDir, ninfo)
+		return nil
+	})
+	if err != nil {
+		fs.errorLog("scanPersistentCache", err)
+	}
+}
+
+// storeDirInfo is the FileInfo of the synthesized store directory.
+type storeDirInfo struct {
+	name string
+}
+
+func (s *storeDirInfo) Name() string       { return s.name }
+func (s *storeDirInfo) Size() int64        { return 0 }
+func (s *storeDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (s *storeDirInfo) ModTime() time.Time { return time.Unix(0, 0) }
+func (s *storeDirInfo) IsDir() bool        { return true }
+func (s *storeDirInfo) Sys() any           { return nil }
+
+// storeDirEntry is an entry of the store directory. Listing the store directory
+// mustn't look up every store path in it, so its type is a guess until the root of
+// the store path has been seen.
+type storeDirEntry struct {
+	fs        *nixHttpCacheFs
+	storePath string
+}
+
+func (e *storeDirEntry) Name() string { return path.Base(e.storePath) }
+func (e *storeDirEntry) IsDir() bool  { return e.Type().IsDir() }
+
+func (e *storeDirEntry) Type() fs.FileMode {
+	if hdr, ok := e.fs.listings.getRoot(e.storePath); ok {
+		return hdr.Mode.Type()
+	}
+	// Derivations are always files and nearly every other store path is a directory.
+	if strings.HasSuffix(e.storePath, ".drv") {
+		return 0
+	}
+	return fs.ModeDir
+}
+
+// Info reports what is already known of the store path, rather than looking it up.
+// Until its root has been seen, its type is guessed.
+func (e *storeDirEntry) Info() (fs.FileInfo, error) {
+	narSize, _ := e.fs.knownPaths.narSize(e.Name())
+	if hdr, ok := e.fs.listings.getRoot(e.storePath); ok {
+		return rootFileInfo(e.storePath, narSize, hdr), nil
+	}
+	mode := e.Type()
+	if mode.IsDir() {
+		mode |= 0o555
+	} else {
+		mode |= 0o444
+	}
+	return &guessedInfo{storeDirInfo: storeDirInfo{name: e.Name()}, mode: mode}, nil
+}
+
+type guessedInfo struct {
+	storeDirInfo
+	mode fs.FileMode
+}
+
+func (g *guessedInfo) Mode() fs.FileMode { return g.mode }
+func (g *guessedInfo) IsDir() bool       { return g.mode.IsDir() }
+
+// storeDirFile is the handle for the synthesized store directory.
+type storeDirFile struct {
+	info    *storeDirInfo
+	entries []fs.DirEntry
+}
+
+func newStoreDirFile(ctx context.Context, cacheFs *nixHttpCacheFs) *storeDirFile {
+	storeDir := cacheFs.getStoreDir(ctx)
+	names := cacheFs.storeDirNames(ctx)
+	return &storeDirFile{
+		info: &storeDirInfo{name: path.Base(storeDir)},
+		entries: lo.Map(names, func(name string, _ int) fs.DirEntry {
+			return &storeDirEntry{fs: cacheFs, storePath: path.Join(storeDir, name)}
+		}),
+	}
+}
+
+func (d *storeDirFile) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *storeDirFile) Read(p []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *storeDirFile) Close() error {
+	return nil
+}
+
+func (d *storeDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	entries := d.entries
+	if n < len(entries) {
+		entries = entries[:n:n]
+		d.entries = d.entries[n:]
+	} else {
+		d.entries = nil
+	}
+	return entries, nil
+}
@@ -0,0 +1,72 @@
+package nix_http_cachefs
+
+import (
+	"bytes"
+	"crypto/sha1" //nolint:gosec // nix still permits sha1 typed hashes
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+)
+
+// verifyingReader counts and hashes everything read through it so the stream
+// can be checked against the sizes and hashes advertised in a narinfo.
+type verifyingReader struct {
+	reader     io.Reader
+	hasher     hash.Hash
+	read       uint64
+	expectHash nixtypes.TypedNixHash
+	expectSize uint64
+	what       string
+}
+
+// newVerifyingReader wraps reader. An empty expected hash or a zero expected size
+// disables that half of the check, since narinfos may omit FileHash/FileSize.
+func newVerifyingReader(reader io.Reader, what string, expectHash nixtypes.TypedNixHash, expectSize uint64) (*verifyingReader, error) {
+	v := &verifyingReader{
+		reader:     reader,
+		expectHash: expectHash,
+		expectSize: expectSize,
+		what:       what,
+	}
+	if expectHash.HashName != "" {
+		switch expectHash.HashName {
+		case "sha1":
+			v.hasher = sha1.New() //nolint:gosec
+		case "sha256":
+			v.hasher = sha256.New()
+		case "sha512":
+			v.hasher = sha512.New()
+		default:
+			return nil, fmt.Errorf("%s: unsupported hash type: %s", what, expectHash.HashName)
+		}
+	}
+	return v, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	v.read += uint64(n)
+	if v.hasher != nil {
+		v.hasher.Write(p[:n])
+	}
+	return n, err
+}
+
+// Verify returns an error if the data read so far does not match the expectations.
+func (v *verifyingReader) Verify() error {
+	if v.expectSize != 0 && v.read != v.expectSize {
+		return fmt.Errorf("%s: size mismatch: expected %d bytes, got %d", v.what, v.expectSize, v.read)
+	}
+	if v.hasher != nil {
+		actual := v.hasher.Sum(nil)
+		if !bytes.Equal(actual, v.expectHash.Hash) {
+			return fmt.Errorf("%s: hash mismatch: expected %s, got %s:%s", v.what,
+				v.expectHash.String(), v.expectHash.HashName, nixtypes.NixBase32Field(actual).String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+// Package version is modified during build to inject version information.
+package version
+
+const Name = "nix-http-cachefs"
+const Description = `Nix HTTP Binary Cache Filesystem`
+
+var Version string = "0.0.0" //nolint:gochecknoglobals
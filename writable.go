@@ -0,0 +1,558 @@
+package nix_http_cachefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	iofs "io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mholt/archives"
+	"github.com/samber/lo"
+	"github.com/spf13/afero"
+	"github.com/wrouesnel/nix-sigman/pkg/nixtypes"
+	"zombiezen.com/go/nix/nar"
+)
+
+// defaultUploadCompression is how uploaded NARs are compressed, as nix copy does.
+const defaultUploadCompression = "xz"
+
+// nixBase32Alphabet are the characters of nix's base32 encoding, which store path
+// hashes are written in.
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// storePathHashLen is the length of the hash part of a store path name.
+const storePathHashLen = 32
+
+// maxStorePathNameLen is the longest name nix allows a store path.
+const maxStorePathNameLen = 211
+
+// nixBase32Chars are the characters of nixBase32Alphabet, indexed by byte.
+var nixBase32Chars = func() (chars [256]bool) { //nolint:gochecknoglobals
+	for _, c := range []byte(nixBase32Alphabet) {
+		chars[c] = true
+	}
+	return chars
+}()
+
+// Committer is implemented by writable filesystems. Store paths written to them are
+// buffered locally until they are committed, when they are uploaded to the cache.
+type Committer interface {
+	// Commit uploads the store path and discards the local copy. It fails if any
+	// file in the store path is still open.
+	Commit(ctx context.Context, storePath string) error
+}
+
+// staging holds the store paths being written, until they are committed. Staged
+// files are kept in a local directory under their store path's base name.
+type staging struct {
+	fs  afero.Fs
+	dir string
+
+	mu    sync.Mutex
+	paths map[string]*stagedPath
+}
+
+// stagedPath is a store path being written.
+type stagedPath struct {
+	// refs is the number of open handles to files in the store path.
+	refs int
+	// committing is set while the store path is being uploaded.
+	committing bool
+}
+
+func newStaging(dir string) *staging {
+	return &staging{
+		fs:    afero.NewBasePathFs(afero.NewOsFs(), dir),
+		dir:   dir,
+		paths: map[string]*stagedPath{},
+	}
+}
+
+// symlink creates a staged symlink. afero's BasePathFs would make the target
+// relative to the staging directory, rather than leaving it as given.
+func (s *staging) symlink(target, stagedName string) error {
+	return os.Symlink(target, filepath.Join(s.dir, filepath.FromSlash(stagedName)))
+}
+
+func (s *staging) readlink(stagedName string) (string, error) {
+	return os.Readlink(filepath.Join(s.dir, filepath.FromSlash(stagedName)))
+}
+
+// stagedFile is a handle to a staged file. The store path is committed when the
+// last handle to it is closed, if it is a single file, with the context the file
+// was opened with.
+type stagedFile struct {
+	afero.File
+	fs   *nixHttpCacheFs
+	ctx  context.Context
+	base string
+}
+
+func (f *stagedFile) Close() error {
+	err := f.File.Close()
+	return errors.Join(err, f.fs.releaseStaged(f.ctx, f.base))
+}
+
+// validStorePathName reports whether base is a valid <hash>-<name> store path name.
+func validStorePathName(base string) bool {
+	hash, name, found := strings.Cut(base, "-")
+	if !found || len(hash) != storePathHashLen || name == "" || len(name) > maxStorePathNameLen || strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, ".narinfo") {
+		return false
+	}
+	for _, r := range hash {
+		if !strings.ContainsRune(nixBase32Alphabet, r) {
+			return false
+		}
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("+-._?=", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// staged returns the name in the staging area of a file in a store path being written.
+func (fs *nixHttpCacheFs) staged(ctx context.Context, name string) (string, string, bool) {
+	if fs.staging == nil {
+		return "", "", false
+	}
+	storePath, within, ok := fs.splitStoreName(ctx, name)
+	if !ok {
+		return "", "", false
+	}
+	base := path.Base(storePath)
+	fs.staging.mu.Lock()
+	defer fs.staging.mu.Unlock()
+	if _, found := fs.staging.paths[base]; !found {
+		return "", "", false
+	}
+	return base, path.Join("/", base, within), true
+}
+
+// stage returns the name in the staging area of a file about to be written. The
+// store path is staged if it isn't already, which fails if the caches already have
+// it: store paths never change once they have been published.
+func (fs *nixHttpCacheFs) stage(ctx context.Context, name string) (string, string, error) {
+	if fs.staging == nil {
+		return "", "", syscall.EPERM
+	}
+	storePath, within, ok := fs.splitStoreName(ctx, name)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return "", "", err
+		}
+		return "", "", syscall.EPERM
+	}
+	base := path.Base(storePath)
+	if !validStorePathName(base) {
+		return "", "", syscall.EINVAL
+	}
+	stagedName := path.Join("/", base, within)
+
+	fs.staging.mu.Lock()
+	if staged, found := fs.staging.paths[base]; found {
+		defer fs.staging.mu.Unlock()
+		if staged.committing {
+			return "", "", syscall.EBUSY
+		}
+		return base, stagedName, nil
+	}
+	fs.staging.mu.Unlock()
+
+	_, err := fs.getNarInfo(ctx, storePath)
+	switch {
+	case err == nil:
+		return "", "", syscall.EEXIST
+	case !errors.Is(err, iofs.ErrNotExist):
+		return "", "", err
+	}
+
+	fs.staging.mu.Lock()
+	defer fs.staging.mu.Unlock()
+	if _, found := fs.staging.paths[base]; !found {
+		fs.staging.paths[base] = &stagedPath{}
+	}
+	return base, stagedName, nil
+}
+
+// unstage abandons a staged store path once its root has been removed.
+func (fs *nixHttpCacheFs) unstage(base string) {
+	if _, err := fs.staging.fs.Stat("/" + base); !os.IsNotExist(err) {
+		return
+	}
+	fs.staging.mu.Lock()
+	defer fs.staging.mu.Unlock()
+	if staged, found := fs.staging.paths[base]; found && staged.refs == 0 && !staged.committing {
+		delete(fs.staging.paths, base)
+	}
+}
+
+// openStaged opens a file in the staging area, tracking the handle so the store
+// path can't be committed while it is open.
+func (fs *nixHttpCacheFs) openStaged(ctx context.Context, base, stagedName string, flag int, perm os.FileMode) (afero.File, error) {
+	fs.staging.mu.Lock()
+	staged, found := fs.staging.paths[base]
+	if !found {
+		fs.staging.mu.Unlock()
+		return nil, iofs.ErrNotExist
+	}
+	staged.refs++
+	fs.staging.mu.Unlock()
+
+	fh, err := fs.staging.fs.OpenFile(stagedName, flag, perm)
+	if err != nil {
+		_ = fs.releaseStaged(ctx, base)
+		return nil, err
+	}
+	return &stagedFile{File: fh, fs: fs, ctx: ctx, base: base}, nil
+}
+
+// releaseStaged drops a handle to a file in a staged store path. Closing the last
+// handle to a store path which is a single file commits it.
+func (fs *nixHttpCacheFs) releaseStaged(ctx context.Context, base string) error {
+	fs.staging.mu.Lock()
+	staged, found := fs.staging.paths[base]
+	if !found {
+		fs.staging.mu.Unlock()
+		return nil
+	}
+	staged.refs--
+	if staged.refs > 0 {
+		fs.staging.mu.Unlock()
+		return nil
+	}
+	fs.staging.mu.Unlock()
+
+	finfo, err := fs.staging.fs.Stat("/" + base)
+	if err != nil || !finfo.Mode().IsRegular() {
+		// Directories are committed explicitly, since there's no telling when
+		// the last file has been written.
+		return nil
+	}
+	return fs.commit(ctx, base)
+}
+
+// Commit implements Committer.
+func (fs *nixHttpCacheFs) Commit(ctx context.Context, storePath string) error {
+	base, _, ok := fs.staged(ctx, storePath)
+	if !ok {
+		return &os.PathError{Op: "commit", Path: storePath, Err: iofs.ErrNotExist}
+	}
+	if err := fs.commit(ctx, base); err != nil {
+		return pathError("commit", storePath, err)
+	}
+	return nil
+}
+
+// commit uploads a staged store path, then discards it. A failed upload leaves the
+// store path staged so it can be committed again.
+func (fs *nixHttpCacheFs) commit(ctx context.Context, base string) error {
+	fs.staging.mu.Lock()
+	staged, found := fs.staging.paths[base]
+	switch {
+	case !found:
+		fs.staging.mu.Unlock()
+		return iofs.ErrNotExist
+	case staged.refs > 0 || staged.committing:
+		fs.staging.mu.Unlock()
+		return syscall.EBUSY
+	}
+	staged.committing = true
+	fs.staging.mu.Unlock()
+
+	err := fs.upload(ctx, base)
+
+	fs.staging.mu.Lock()
+	defer fs.staging.mu.Unlock()
+	staged.committing = false
+	if err != nil {
+		return err
+	}
+	delete(fs.staging.paths, base)
+	if err := fs.staging.fs.RemoveAll("/" + base); err != nil {
+		fs.errorLog("commit", err)
+	}
+	return nil
+}
+
+// upload serializes a staged store path to a NAR and uploads it to the first cache,
+// followed by its narinfo, as nix copy does. The narinfo goes last so the cache never
+// advertises a store path it can't serve.
+func (fs *nixHttpCacheFs) upload(ctx context.Context, base string) error {
+	storePath := path.Join(fs.getStoreDir(ctx), base)
+	fs.debugLog("upload", storePath)
+
+	// Nothing is uploaded to a cache which the filesystem wouldn't read it back from.
+	cacheUrl := fs.cacheUrls[0]
+	if !lo.Contains(fs.caches(ctx), cacheUrl) {
+		return fmt.Errorf("can't upload to %s: it serves a different store directory", cacheUrl.Redacted())
+	}
+
+	narFile, err := NewCacheFile(base + ".nar")
+	if err != nil {
+		return err
+	}
+	defer narFile.Close()
+
+	// The store path may refer to itself, as well as to any other we know of.
+	refs := newReferenceScanner(append(fs.storeDirNames(ctx), base))
+	narHash := sha256.New()
+	narCounter := &countingWriter{}
+	if err := fs.writeStagedNar(base, io.MultiWriter(narFile, narHash, narCounter, refs)); err != nil {
+		return err
+	}
+	if _, err := narFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	listing, err := nar.List(narFile)
+	if err != nil {
+		return err
+	}
+
+	compression := fs.opts.uploadCompression
+	compressor := compressorFor(compression)
+	extension := ""
+	fileFile := narFile
+	if compressor != nil {
+		extension = compressor.(archives.Format).Extension()
+		if fileFile, err = NewCacheFile(base + ".nar" + extension); err != nil {
+			return err
+		}
+		defer fileFile.Close()
+		if err := compressFile(compressor, fileFile, narFile); err != nil {
+			return err
+		}
+	}
+	fileHash := sha256.New()
+	fileCounter := &countingWriter{}
+	if _, err := fileFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(fileHash, fileCounter), fileFile); err != nil {
+		return err
+	}
+
+	fileHashField := nixtypes.NixBase32Field(fileHash.Sum(nil))
+	ninfo := &nixtypes.NarInfo{
+		StorePath:   storePath,
+		URL:         fmt.Sprintf("nar/%s.nar%s", fileHashField.String(), extension),
+		Compression: lo.Ternary(compressor != nil, compression, "none"),
+		FileHash:    nixtypes.TypedNixHash{HashName: "sha256", Hash: fileHashField},
+		FileSize:    uint64(fileCounter.n),
+		NarHash:     nixtypes.TypedNixHash{HashName: "sha256", Hash: narHash.Sum(nil)},
+		NarSize:     uint64(narCounter.n),
+		References:  refs.references(),
+		Sig:         []nixtypes.NixSignature{},
+	}
+	if fs.opts.signingKey != nil {
+		if ninfo, err = fs.signNarInfo(ninfo); err != nil {
+			return err
+		}
+	}
+	ninfoBytes, err := ninfo.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	narUrl := cacheUrl.JoinPath(ninfo.URL)
+	if err := fs.put(ctx, cacheUrl, narUrl.String(), "application/x-nix-nar", fileFile, fileCounter.n); err != nil {
+		return err
+	}
+	hashPart, _, _ := strings.Cut(base, "-")
+	ninfoUrl := cacheUrl.JoinPath(hashPart + ".narinfo")
+	err = fs.put(ctx, cacheUrl, ninfoUrl.String(), "text/x-nix-narinfo", bytes.NewReader(ninfoBytes), int64(len(ninfoBytes)))
+	if err != nil {
+		return err
+	}
+
+	// The store path was looked up, and found missing, when it was staged.
+	if err := fs.misses.removeMissing(ninfoUrl); err != nil {
+		fs.errorLog("negative cache", err)
+	}
+	fs.knownPaths.add(storePath)
+	fs.listings.addListing(storePath, listing)
+	if fs.narStore != nil {
+		if err := fs.narStore.add(ninfo, narFile, listing); err != nil {
+			fs.errorLog("NAR store", err)
+		}
+	}
+	return nil
+}
+
+// writeStagedNar serializes a staged store path as a NAR.
+func (fs *nixHttpCacheFs) writeStagedNar(base string, w io.Writer) error {
+	root := "/" + base
+	nw := nar.NewWriter(w)
+	err := afero.Walk(fs.staging.fs, root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hdr := &nar.Header{Path: strings.TrimPrefix(strings.TrimPrefix(name, root), "/")}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := fs.staging.readlink(name)
+			if err != nil {
+				return err
+			}
+			hdr.Mode = iofs.ModeSymlink
+			hdr.LinkTarget = target
+			return nw.WriteHeader(hdr)
+		case info.IsDir():
+			hdr.Mode = iofs.ModeDir
+			return nw.WriteHeader(hdr)
+		case info.Mode().IsRegular():
+			// NARs only record whether a file is executable.
+			hdr.Mode = lo.Ternary[iofs.FileMode](info.Mode()&0o111 != 0, 0o555, 0o444)
+			hdr.Size = info.Size()
+			if err := nw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			fh, err := fs.staging.fs.Open(name)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			_, err = io.Copy(nw, fh)
+			return err
+		default:
+			return fmt.Errorf("%s: can't store %v files", name, info.Mode().Type())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return nw.Close()
+}
+
+// put uploads the whole of body to uri on the cache at cacheUrl, retrying as get does.
+func (fs *nixHttpCacheFs) put(ctx context.Context, cacheUrl *url.URL, uri string, contentType string,
+	body io.ReadSeeker, size int64,
+) error {
+	fs.debugLog("HTTP Request", http.MethodPut, uri)
+	resp, err := fs.retry(ctx, cacheUrl, uri, func() (*http.Request, error) {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		// The transport closes request bodies, but body is sent again by a retry.
+		req, err := fs.newRequest(ctx, http.MethodPut, uri, io.NopCloser(body))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &CacheError{URL: uri, Kind: ErrTransient, Err: err}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if kind := statusKind(resp.StatusCode); kind != nil {
+		return &CacheError{URL: uri, Kind: kind, Err: errors.New(resp.Status)}
+	}
+	return nil
+}
+
+// compressorFor returns the compressor for a narinfo Compression value, or nil if
+// NARs are to be stored uncompressed.
+func compressorFor(compression string) archives.Compressor {
+	if decompressor := decompressorFor(compression); decompressor != nil {
+		return decompressor.(archives.Compressor)
+	}
+	return nil
+}
+
+// compressFile compresses the whole of src into dst.
+func compressFile(compressor archives.Compressor, dst io.Writer, src io.ReadSeeker) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cw, err := compressor.OpenWriter(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, src); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// referenceScanner finds references to store paths in a NAR written to it, as nix
+// does when adding a path to the store: the NAR refers to each of the candidate
+// store paths whose hash part appears anywhere in it, whether or not the rest of
+// the store path follows. Hash parts can be split across writes, so the tail of
+// each write is kept until the next one.
+type referenceScanner struct {
+	// candidates are the names of the candidate store paths, by their hash parts.
+	candidates map[string]string
+	refs       map[string]struct{}
+	buf        []byte
+}
+
+func newReferenceScanner(candidates []string) *referenceScanner {
+	r := &referenceScanner{candidates: make(map[string]string, len(candidates)), refs: map[string]struct{}{}}
+	for _, name := range candidates {
+		if hashPart, _, found := strings.Cut(name, "-"); found && len(hashPart) == storePathHashLen {
+			r.candidates[hashPart] = name
+		}
+	}
+	return r
+}
+
+func (r *referenceScanner) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	start := 0
+	for start+storePathHashLen <= len(r.buf) {
+		// Checking from the end of the window lets a character which can't be part
+		// of a hash skip every window containing it.
+		i := storePathHashLen - 1
+		for i >= 0 && nixBase32Chars[r.buf[start+i]] {
+			i--
+		}
+		if i >= 0 {
+			start += i + 1
+			continue
+		}
+		if name, found := r.candidates[string(r.buf[start:start+storePathHashLen])]; found {
+			r.refs[name] = struct{}{}
+		}
+		start++
+	}
+	// What's left is too short to be a hash part, but may be the start of one.
+	r.buf = append(r.buf[:0], r.buf[start:]...)
+	return len(p), nil
+}
+
+// references returns the names of the referenced store paths, sorted.
+func (r *referenceScanner) references() []string {
+	refs := lo.Keys(r.refs)
+	sort.Strings(refs)
+	return refs
+}